@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commandTimeout bounds a one-shot command, login included
+const commandTimeout = 2 * time.Minute
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, accounts []hipchat.Account,
+		args []string) error
+}
+
+// one-shot commands, they use the hipchat accounts but not priscilla
+var commands = map[string]*command{
+	"send": {
+		usage: "send ROOM [MESSAGE...]: send a message, read from standard " +
+			"input when not given",
+		run: sendCommand,
+	},
+	"rooms": {
+		usage: "rooms: list the rooms of every account",
+		run:   roomsCommand,
+	},
+	"whois": {
+		usage: "whois USER: look a user up by jid, id, email or @mention",
+		run:   whoisCommand,
+	},
+	"check": {
+		usage: "check: validate the config and log every account in",
+		run:   checkCommand,
+	},
+}
+
+// runCommand runs a one-shot command and returns the exit status
+func runCommand(name string, accounts []hipchat.Account, args []string) int {
+	if len(accounts) == 0 {
+		logger.Error.Println("No hipchat account configured")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := commands[name].run(ctx, accounts, args); err != nil {
+		fmt.Fprintln(os.Stderr, name+":", err)
+		return 1
+	}
+	return 0
+}
+
+// commandAccount picks the account of an account qualified name, the default
+// account for unqualified ones
+func commandAccount(accounts []hipchat.Account,
+	name string) (*hipchat.Account, string, error) {
+
+	if idx := strings.Index(name, hipchat.AccountSep); idx > 0 {
+		for i := range accounts {
+			if accounts[i].Name == name[:idx] {
+				return &accounts[i], name[idx+len(hipchat.AccountSep):], nil
+			}
+		}
+	}
+
+	for i := range accounts {
+		if accounts[i].Name == "" {
+			return &accounts[i], name, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("No account found for %s", name)
+}
+
+func sendCommand(ctx context.Context, accounts []hipchat.Account,
+	args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("No room given")
+	}
+
+	message := strings.Join(args[1:], " ")
+	if message == "" {
+		in, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		message = strings.TrimSpace(string(in))
+	}
+	if message == "" {
+		return errors.New("Nothing to send")
+	}
+
+	acc, room, err := commandAccount(accounts, args[0])
+	if err != nil {
+		return err
+	}
+
+	session, err := hipchat.Connect(ctx, *acc)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Send(room, message)
+}
+
+func roomsCommand(ctx context.Context, accounts []hipchat.Account,
+	args []string) error {
+
+	for _, acc := range accounts {
+		session, err := hipchat.Connect(ctx, acc)
+		if err != nil {
+			return err
+		}
+
+		for _, room := range session.Rooms() {
+			name := room.Name
+			if acc.Name != "" {
+				name = acc.Name + hipchat.AccountSep + name
+			}
+			fmt.Printf("%s\t%s\n", name, room.Id)
+		}
+		session.Close()
+	}
+
+	return nil
+}
+
+func whoisCommand(ctx context.Context, accounts []hipchat.Account,
+	args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("Exactly one user expected")
+	}
+
+	acc, name, err := commandAccount(accounts, args[0])
+	if err != nil {
+		return err
+	}
+
+	session, err := hipchat.Connect(ctx, *acc)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	user, err := session.Whois(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("jid\t%s\nname\t%s\nmention\t%s\nemail\t%s\n", user.Jid,
+		user.Name, user.Mention, user.Email)
+	return nil
+}
+
+func checkCommand(ctx context.Context, accounts []hipchat.Account,
+	args []string) error {
+
+	failed := 0
+
+	for _, acc := range accounts {
+		name := acc.Name
+		if name == "" {
+			name = "default"
+		}
+
+		session, err := hipchat.Connect(ctx, acc)
+		if err != nil {
+			fmt.Printf("%s\tFAILED\t%s\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s\tOK\t%d rooms\n", name, len(session.Rooms()))
+		session.Close()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts failed", failed, len(accounts))
+	}
+	return nil
+}
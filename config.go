@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSecret = "abcdefg"
+	fileSuffix    = "_file"
+)
+
+type config struct {
+	Port     int                      `yaml:"port"`
+	Secret   string                   `yaml:"secret"`
+	Adapters map[string]adapterConfig `yaml:"adapters"`
+}
+
+type adapterConfig struct {
+	Params   map[string]*string            `yaml:"params"`
+	Accounts map[string]map[string]*string `yaml:"accounts"`
+}
+
+// adapterSettings is the resolved configuration of one adapter section, with
+// environment variables expanded and file indirections read
+type adapterSettings struct {
+	port     int
+	secret   string
+	params   map[string]string
+	accounts map[string]map[string]string
+}
+
+type configError struct {
+	location string
+	msg      string
+}
+
+func (e *configError) Error() string {
+	return e.location + ": " + e.msg
+}
+
+type configErrors []error
+
+func (errs configErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var (
+	adapterKeys = map[string]bool{
+		"params":   true,
+		"accounts": true,
+	}
+
+	paramKeys = map[string]bool{
+		"user":              true,
+		"pass":              true,
+		"nick":              true,
+		"server":            true,
+		"id":                true,
+		"loglevel":          true,
+		"logfile":           true,
+		"logformat":         true,
+		"rooms":             true,
+		"ratelimit":         true,
+		"http":              true,
+		"admin":             true,
+		"admintoken":        true,
+		"record":            true,
+		"readonly":          true,
+		"shadowroom":        true,
+		"filedir":           true,
+		"filelimit":         true,
+		"dropnotifications": true,
+		"format":            true,
+		"roomformats":       true,
+		"stripansi":         true,
+	}
+
+	accountKeys = map[string]bool{
+		"user":      true,
+		"pass":      true,
+		"nick":      true,
+		"rooms":     true,
+		"ratelimit": true,
+	}
+
+	envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+func loadAdapterConfig(file, name string) (*adapterSettings, error) {
+	confRaw, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error reading conf file: %s", err)
+	}
+
+	var conf config
+
+	if err := yaml.Unmarshal(confRaw, &conf); err != nil {
+		return nil, fmt.Errorf("Error parsing conf file: %s", err)
+	}
+
+	hcconf, ok := conf.Adapters[name]
+
+	if !ok {
+		return nil, fmt.Errorf("%s is not found in config adapters section",
+			name)
+	}
+
+	var errs configErrors
+	settings := &adapterSettings{
+		port:     conf.Port,
+		accounts: make(map[string]map[string]string),
+	}
+
+	settings.secret, err = expandEnv("secret", conf.Secret)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	location := "adapters." + name
+
+	errs = append(errs, unknownAdapterKeys(confRaw, name, location)...)
+
+	params, perrs := resolveParams(location+".params", hcconf.Params,
+		paramKeys)
+	errs = append(errs, perrs...)
+	settings.params = params
+
+	if _, _, err := clientSettings(params, nil); err != nil {
+		errs = append(errs, &configError{location + ".params", err.Error()})
+	}
+
+	if _, err := parseBool(params["readonly"]); err != nil {
+		errs = append(errs, &configError{location + ".params.readonly",
+			err.Error()})
+	}
+
+	if _, err := parseSize(params["filelimit"]); err != nil {
+		errs = append(errs, &configError{location + ".params.filelimit",
+			err.Error()})
+	}
+
+	if _, err := parseBool(params["dropnotifications"]); err != nil {
+		errs = append(errs, &configError{location + ".params.dropnotifications",
+			err.Error()})
+	}
+
+	if _, err := parseBool(params["stripansi"]); err != nil {
+		errs = append(errs, &configError{location + ".params.stripansi",
+			err.Error()})
+	}
+
+	if _, err := parseFormat(params["format"]); err != nil {
+		errs = append(errs, &configError{location + ".params.format",
+			err.Error()})
+	}
+
+	if _, err := parseFormats(params["roomformats"]); err != nil {
+		errs = append(errs, &configError{location + ".params.roomformats",
+			err.Error()})
+	}
+
+	if params["user"] != "" && params["pass"] == "" {
+		errs = append(errs, &configError{location + ".params",
+			"missing key \"pass\" (or \"pass" + fileSuffix + "\")"})
+	}
+
+	names := make([]string, 0, len(hcconf.Accounts))
+	for account := range hcconf.Accounts {
+		names = append(names, account)
+	}
+	sort.Strings(names)
+
+	for _, account := range names {
+		accLocation := location + ".accounts." + account
+
+		if account == "" || strings.Contains(account, hipchat.AccountSep) {
+			errs = append(errs, &configError{accLocation,
+				"account name must be non-empty and not contain \"" +
+					hipchat.AccountSep + "\""})
+			continue
+		}
+
+		accParams, aerrs := resolveParams(accLocation,
+			hcconf.Accounts[account], accountKeys)
+		errs = append(errs, aerrs...)
+
+		for _, key := range []string{"user", "pass"} {
+			if accParams[key] == "" {
+				errs = append(errs, &configError{accLocation,
+					"missing key \"" + key + "\" (or \"" + key + fileSuffix +
+						"\")"})
+			}
+		}
+
+		if _, _, err := clientSettings(params, accParams); err != nil {
+			errs = append(errs, &configError{accLocation, err.Error()})
+		}
+
+		settings.accounts[account] = accParams
+	}
+
+	if len(errs) > 0 {
+		return settings, errs
+	}
+
+	return settings, nil
+}
+
+// unknownAdapterKeys reports the keys of the adapter section that aren't
+// params or accounts, a misspelled one would be ignored otherwise. The rest
+// of the file belongs to priscilla and the other adapters. The section is
+// read again untyped, the typed config drops unknown keys.
+func unknownAdapterKeys(confRaw []byte, name, location string) []error {
+	var raw struct {
+		Adapters map[string]map[string]interface{} `yaml:"adapters"`
+	}
+	if err := yaml.Unmarshal(confRaw, &raw); err != nil {
+		return []error{&configError{location, err.Error()}}
+	}
+
+	keys := make([]string, 0, len(raw.Adapters[name]))
+	for key := range raw.Adapters[name] {
+		if !adapterKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, 0, len(keys))
+	for _, key := range keys {
+		errs = append(errs, &configError{location + "." + key, "unknown key"})
+	}
+	return errs
+}
+
+// resolveParams checks every key of a params block against the known keys and
+// resolves the values. A key may also be given as <key>_file, in which case
+// the value is read from the named file.
+func resolveParams(location string, params map[string]*string,
+	known map[string]bool) (map[string]string, []error) {
+
+	resolved := make(map[string]string)
+	var errs []error
+
+	for _, key := range sortedKeys(params) {
+		keyLocation := location + "." + key
+		name := strings.TrimSuffix(key, fileSuffix)
+
+		if !known[name] {
+			errs = append(errs, &configError{keyLocation, "unknown key"})
+			continue
+		}
+
+		if _, dup := params[name]; dup && name != key {
+			errs = append(errs, &configError{keyLocation,
+				"conflicts with \"" + name + "\""})
+			continue
+		}
+
+		if params[key] == nil {
+			continue
+		}
+
+		value, err := expandEnv(keyLocation, *params[key])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if name != key {
+			value, err = readSecretFile(keyLocation, value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		resolved[name] = value
+	}
+
+	return resolved, errs
+}
+
+// expandEnv substitutes ${VAR} references with the value of the environment
+// variable, a reference to an unset variable is an error. A bare $ is left
+// alone, passwords may well contain one.
+func expandEnv(location, value string) (string, error) {
+	var err error
+
+	expanded := envRef.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = &configError{location,
+				"environment variable " + name + " is not set"}
+		}
+		return env
+	})
+
+	return expanded, err
+}
+
+func readSecretFile(location, file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return "", &configError{location, err.Error()}
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// parseBool parses a boolean param, empty means false
+func parseBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid boolean %q", value)
+	}
+	return b, nil
+}
+
+// parseSize parses a size in bytes, empty means 0
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", value)
+	}
+	return n, nil
+}
+
+// parseFormat checks a message format, empty is the default
+func parseFormat(value string) (string, error) {
+	switch value {
+	case "", hipchat.FormatNone, hipchat.FormatText, hipchat.FormatHTML:
+		return value, nil
+	}
+	return "", fmt.Errorf("Invalid format %q", value)
+}
+
+// parseFormats parses comma separated room=format pairs
+func parseFormats(value string) (map[string]string, error) {
+	formats := make(map[string]string)
+	if value == "" {
+		return formats, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		idx := strings.LastIndex(pair, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("Invalid room format %q", pair)
+		}
+		format, err := parseFormat(strings.TrimSpace(pair[idx+1:]))
+		if err != nil {
+			return nil, err
+		}
+		formats[strings.TrimSpace(pair[:idx])] = format
+	}
+	return formats, nil
+}
+
+func sortedKeys(m map[string]*string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
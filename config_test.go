@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func str(s string) *string {
+	return &s
+}
+
+// errorStrings returns the messages of errs, for comparing
+func errorStrings(errs []error) []string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("PH_TEST_USER", "1_2")
+	os.Unsetenv("PH_TEST_UNSET")
+	defer os.Unsetenv("PH_TEST_USER")
+
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"plain", "plain", ""},
+		{"${PH_TEST_USER}", "1_2", ""},
+		{"id ${PH_TEST_USER}@chat", "id 1_2@chat", ""},
+		{"pa$$word", "pa$$word", ""},
+		{"$PH_TEST_USER", "$PH_TEST_USER", ""},
+		{"${PH_TEST_UNSET}", "",
+			"key: environment variable PH_TEST_UNSET is not set"},
+	}
+
+	for _, test := range tests {
+		got, err := expandEnv("key", test.value)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+		}
+		if got != test.want {
+			t.Errorf("%q expanded to %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-hipchat-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "pass")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	os.Setenv("PH_TEST_SECRET", secret)
+	defer os.Unsetenv("PH_TEST_SECRET")
+
+	tests := []struct {
+		name   string
+		params map[string]*string
+		want   map[string]string
+		errs   []string
+	}{
+		{
+			name:   "plain",
+			params: map[string]*string{"user": str("1_2"), "nick": str("P")},
+			want:   map[string]string{"user": "1_2", "nick": "P"},
+		},
+		{
+			name:   "empty value",
+			params: map[string]*string{"nick": nil},
+			want:   map[string]string{},
+		},
+		{
+			name:   "file",
+			params: map[string]*string{"pass_file": str(secret)},
+			want:   map[string]string{"pass": "s3cret"},
+		},
+		{
+			name:   "file from env",
+			params: map[string]*string{"pass_file": str("${PH_TEST_SECRET}")},
+			want:   map[string]string{"pass": "s3cret"},
+		},
+		{
+			name:   "missing file",
+			params: map[string]*string{"pass_file": str(missing)},
+			want:   map[string]string{},
+			errs: []string{"p.pass_file: open " + missing +
+				": no such file or directory"},
+		},
+		{
+			name: "unknown",
+			params: map[string]*string{
+				"usr":      str("1_2"),
+				"nick_fle": str("x"),
+				"nick":     str("P"),
+			},
+			want: map[string]string{"nick": "P"},
+			errs: []string{"p.nick_fle: unknown key", "p.usr: unknown key"},
+		},
+		{
+			name: "conflict",
+			params: map[string]*string{
+				"pass":      str("inline"),
+				"pass_file": str(secret),
+			},
+			want: map[string]string{"pass": "inline"},
+			errs: []string{`p.pass_file: conflicts with "pass"`},
+		},
+	}
+
+	for _, test := range tests {
+		got, errs := resolveParams("p", test.params, accountKeys)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: resolved %v, want %v", test.name, got, test.want)
+		}
+		want := test.errs
+		if want == nil {
+			want = []string{}
+		}
+		if msgs := errorStrings(errs); !reflect.DeepEqual(msgs, want) {
+			t.Errorf("%s: errors %q, want %q", test.name, msgs, want)
+		}
+	}
+}
+
+func TestLoadAdapterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-hipchat-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		conf string
+		errs []string
+	}{
+		{
+			name: "valid",
+			conf: `
+adapters:
+  hipchat:
+    params:
+      user: 1_2
+      pass: secret
+    accounts:
+      ops:
+        user: 1_3
+        pass: secret
+`,
+		},
+		{
+			name: "unknown keys",
+			conf: `
+adapters:
+  hipchat:
+    parms:
+      user: 1_2
+    params:
+      usr: 1_2
+    accounts:
+      ops:
+        user: 1_3
+        pass: secret
+        room: Eng
+`,
+			errs: []string{
+				"adapters.hipchat.parms: unknown key",
+				"adapters.hipchat.params.usr: unknown key",
+				"adapters.hipchat.accounts.ops.room: unknown key",
+			},
+		},
+		{
+			name: "missing keys",
+			conf: `
+adapters:
+  hipchat:
+    params:
+      user: 1_2
+    accounts:
+      ops:
+        nick: Ops
+`,
+			errs: []string{
+				`adapters.hipchat.params: missing key "pass" (or "pass_file")`,
+				`adapters.hipchat.accounts.ops: missing key "user" ` +
+					`(or "user_file")`,
+				`adapters.hipchat.accounts.ops: missing key "pass" ` +
+					`(or "pass_file")`,
+			},
+		},
+		{
+			name: "invalid values",
+			conf: `
+adapters:
+  hipchat:
+    params:
+      readonly: maybe
+      format: rtf
+    accounts:
+      "ops:eng":
+        user: 1_3
+        pass: secret
+`,
+			errs: []string{
+				`adapters.hipchat.params.readonly: Invalid boolean "maybe"`,
+				`adapters.hipchat.params.format: Invalid format "rtf"`,
+				`adapters.hipchat.accounts.ops:eng: account name must be ` +
+					`non-empty and not contain ":"`,
+			},
+		},
+	}
+
+	for i, test := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("conf%d.yml", i))
+		err := ioutil.WriteFile(file, []byte(test.conf), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadAdapterConfig(file, "hipchat")
+		var msgs []string
+		if err != nil {
+			msgs = strings.Split(err.Error(), "\n")
+		}
+		if !reflect.DeepEqual(msgs, test.errs) {
+			t.Errorf("%s: errors %q, want %q", test.name, msgs, test.errs)
+		}
+	}
+
+	if _, err := loadAdapterConfig(filepath.Join(dir, "conf0.yml"),
+		"slack"); err == nil {
+		t.Error("Missing adapter section accepted")
+	}
+}
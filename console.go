@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat/hipchattest"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"io"
+	"strings"
+)
+
+// console stands in for hipchat: every line typed is said by user in room,
+// and whatever the adapter says is printed
+type console struct {
+	server *hipchattest.Server
+	user   string
+	room   string
+}
+
+func newConsole(nick, user, room string, out io.Writer) *console {
+	server := &hipchattest.Server{
+		Bot: xmpp.User{
+			Jid:     "1_1@chat.hipchat.com",
+			Name:    nick,
+			Mention: mentionName(nick),
+		},
+		Users: []xmpp.User{{
+			Jid:     "1_2@chat.hipchat.com",
+			Name:    user,
+			Mention: mentionName(user),
+			Email:   mentionName(user) + "@localhost",
+		}},
+		Rooms: []xmpp.Room{{
+			Id: "1_" + strings.ToLower(mentionName(room)) +
+				"@conf.hipchat.com",
+			Name: room,
+		}},
+		OnMessage: func(room, body string) {
+			fmt.Fprintf(out, "[%s] %s: %s\n", room, nick, body)
+		},
+	}
+
+	return &console{server: server, user: user, room: room}
+}
+
+func mentionName(name string) string {
+	return strings.Replace(name, " ", "", -1)
+}
+
+// read says the lines of in until it ends
+func (c *console) read(in io.Reader, out io.Writer) error {
+	fmt.Fprintf(out, "Talking as %s in %s, mention the bot with @%s\n",
+		c.user, c.room, c.server.Bot.Mention)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := c.server.Say(c.user, c.room, line); err != nil {
+			logger.Error.Println("Console:", err)
+		}
+	}
+
+	return scanner.Err()
+}
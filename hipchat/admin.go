@@ -0,0 +1,387 @@
+package hipchat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const adminTimeout = 30 * time.Second
+
+// adminServer is a small local HTTP/JSON API for operators. Everything that
+// touches client state is handed to the run loop through requests, so it
+// doesn't race with message handling.
+type adminServer struct {
+	bridge   *Bridge
+	clients  map[string]*client
+	token    string
+	requests chan<- func()
+}
+
+type adminRoom struct {
+	Account string `json:"account,omitempty"`
+	Name    string `json:"name"`
+	Id      string `json:"id"`
+	Joined  bool   `json:"joined"`
+}
+
+type adminUser struct {
+	Account string `json:"account,omitempty"`
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Mention string `json:"mention"`
+	Email   string `json:"email"`
+}
+
+type adminRequest struct {
+	Account string `json:"account"`
+	Room    string `json:"room"`
+	Message string `json:"message"`
+}
+
+// isLoopback tells whether addr only listens on the loopback interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// AdminHandler serves the admin API of the bridge for a listener on addr,
+// which has to be bound to localhost unless token is set
+func (b *Bridge) AdminHandler(addr, token string) (http.Handler, error) {
+	if token == "" && !isLoopback(addr) {
+		return nil, fmt.Errorf("Admin API on %s must be bound to localhost "+
+			"or protected with a token", addr)
+	}
+
+	a := &adminServer{
+		bridge:   b,
+		clients:  b.clients,
+		token:    token,
+		requests: b.requests,
+	}
+	return a.handler(), nil
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rooms", a.get(a.rooms))
+	mux.HandleFunc("/rooms/join", a.post(a.join))
+	mux.HandleFunc("/rooms/leave", a.post(a.leave))
+	mux.HandleFunc("/users", a.get(a.users))
+	mux.HandleFunc("/users/refresh", a.post(a.refreshUsers))
+	mux.HandleFunc("/message", a.post(a.message))
+	mux.HandleFunc("/reconnect", a.post(a.reconnect))
+	return a.authorize(mux)
+}
+
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.token != "" {
+			given := strings.TrimPrefix(req.Header.Get("Authorization"),
+				"Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given),
+				[]byte(a.token)) != 1 {
+				adminError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type adminAction func(req *adminRequest) (interface{}, int, error)
+
+func (a *adminServer) get(action adminAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			adminError(w, http.StatusMethodNotAllowed, "GET only")
+			return
+		}
+		a.serve(w, &adminRequest{Account: req.URL.Query().Get("account")},
+			action)
+	}
+}
+
+func (a *adminServer) post(action adminAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			adminError(w, http.StatusMethodNotAllowed, "POST only")
+			return
+		}
+
+		request := new(adminRequest)
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		a.serve(w, request, action)
+	}
+}
+
+// serve runs action on the run loop and writes its result
+func (a *adminServer) serve(w http.ResponseWriter, request *adminRequest,
+	action adminAction) {
+
+	var result interface{}
+	var status int
+	var err error
+
+	done := make(chan struct{})
+	fn := func() {
+		result, status, err = action(request)
+		close(done)
+	}
+
+	select {
+	case a.requests <- fn:
+	case <-time.After(adminTimeout):
+		adminError(w, http.StatusServiceUnavailable, "Adapter is busy")
+		return
+	}
+	<-done
+
+	if err != nil {
+		adminError(w, status, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// selected returns the clients a request applies to, all of them when no
+// account is given
+func (a *adminServer) selected(account string) ([]*client, error) {
+	if account != "" {
+		if c, ok := a.clients[account]; ok {
+			return []*client{c}, nil
+		}
+		return nil, fmt.Errorf("Unknown account: %s", account)
+	}
+
+	names := make([]string, 0, len(a.clients))
+	for name := range a.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	selected := make([]*client, 0, len(names))
+	for _, name := range names {
+		selected = append(selected, a.clients[name])
+	}
+	return selected, nil
+}
+
+func (a *adminServer) rooms(req *adminRequest) (interface{}, int, error) {
+	clients, err := a.selected(req.Account)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	rooms := []adminRoom{}
+	for _, c := range clients {
+		for _, room := range c.roomList() {
+			rooms = append(rooms, adminRoom{
+				Account: c.account,
+				Name:    room.Name,
+				Id:      room.Id,
+				Joined:  c.isJoined(room.Id),
+			})
+		}
+	}
+	return rooms, http.StatusOK, nil
+}
+
+func (a *adminServer) users(req *adminRequest) (interface{}, int, error) {
+	clients, err := a.selected(req.Account)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	users := []adminUser{}
+	for _, c := range clients {
+		for _, user := range c.userList() {
+			users = append(users, adminUser{
+				Account: c.account,
+				Id:      user.Jid,
+				Name:    user.Name,
+				Mention: user.Mention,
+				Email:   user.Email,
+			})
+		}
+	}
+	return users, http.StatusOK, nil
+}
+
+func (a *adminServer) refreshUsers(
+	req *adminRequest) (interface{}, int, error) {
+
+	clients, err := a.selected(req.Account)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	refreshing := 0
+	for _, c := range clients {
+		if c.login().api == nil {
+			continue
+		}
+		var jids []string
+		for _, user := range c.userList() {
+			if user.Jid != c.login().jid {
+				jids = append(jids, user.Jid)
+			}
+		}
+		refreshing += len(jids)
+		go a.refresh(c, jids)
+	}
+
+	return map[string]int{"refreshing": refreshing}, http.StatusAccepted, nil
+}
+
+// refresh fetches users through the REST API off the run loop, and updates
+// them on it
+func (a *adminServer) refresh(c *client, jids []string) {
+	var users []*xmpp.User
+	for _, jid := range jids {
+		user, err := c.fetchUser(jid)
+		if err != nil {
+			logger.Error.Println("Failed to refresh user", jid+":", err)
+			continue
+		}
+		users = append(users, user)
+	}
+
+	err := a.bridge.Do(func() {
+		for _, user := range users {
+			c.addUser(user)
+		}
+	})
+	if err != nil {
+		logger.Error.Println("Failed to update refreshed users:", err)
+		return
+	}
+	logger.Info.Println("Refreshed", len(users), "of", len(jids),
+		"users of account", c.account)
+}
+
+// room resolves the account and room id a join or leave request is about
+func (a *adminServer) room(req *adminRequest) (*client, string, error) {
+	c, room := splitAccount(a.clients, req.Room)
+	if req.Account != "" {
+		c, room = a.clients[req.Account], req.Room
+	}
+
+	if c == nil {
+		return nil, "", fmt.Errorf("No account found for room: %s", req.Room)
+	}
+
+	id, ok := c.roomId(room)
+	if !ok {
+		return nil, "", fmt.Errorf("Room not found: %s", req.Room)
+	}
+
+	if c.conn() == nil || c.login().jid == "" {
+		return nil, "", fmt.Errorf("Account is not connected")
+	}
+
+	return c, id, nil
+}
+
+func (a *adminServer) join(req *adminRequest) (interface{}, int, error) {
+	c, id, err := a.room(req)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if c.readOnly("joining", []string{id}) {
+		return map[string]string{"read_only": id}, http.StatusOK, nil
+	}
+	c.join([]string{id})
+	return map[string]string{"joined": id}, http.StatusOK, nil
+}
+
+func (a *adminServer) leave(req *adminRequest) (interface{}, int, error) {
+	c, id, err := a.room(req)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if c.readOnly("leaving", []string{id}) {
+		return map[string]string{"read_only": id}, http.StatusOK, nil
+	}
+	c.leave([]string{id})
+	return map[string]string{"left": id}, http.StatusOK, nil
+}
+
+func (a *adminServer) message(req *adminRequest) (interface{}, int, error) {
+	room := req.Room
+	if req.Account != "" {
+		room = req.Account + AccountSep + room
+	}
+
+	c, name := splitAccount(a.clients, room)
+	if c == nil {
+		return nil, http.StatusNotFound,
+			fmt.Errorf("No account found for room: %s", room)
+	}
+
+	if _, ok := c.roomId(name); !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("Room not found: %s", room)
+	}
+
+	q := &queuedMessage{
+		message: &prisclient.MessageBlock{
+			Room:    name,
+			Message: req.Message,
+		},
+		room:   room,
+		queued: time.Now(),
+	}
+	// a notification that fails later is only logged, nobody's waiting
+	err := c.groupMessage(q, func(room, message, reason string) {})
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+
+	return map[string]string{"sent": room}, http.StatusOK, nil
+}
+
+func (a *adminServer) reconnect(req *adminRequest) (interface{}, int, error) {
+	clients, err := a.selected(req.Account)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	// listen notices the dropped connection and reconnects
+	for _, c := range clients {
+		if conn := c.conn(); conn != nil {
+			logger.Warn.Println("Reconnect of account", c.account,
+				"requested through admin API")
+			conn.Disconnect()
+		}
+	}
+
+	return map[string]int{"reconnecting": len(clients)}, http.StatusOK, nil
+}
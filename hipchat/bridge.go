@@ -0,0 +1,758 @@
+package hipchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"github.com/priscillachat/prislog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func keepAliveTrigger(ctx context.Context, trigger chan<- bool) {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case trigger <- true:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Priscilla is the priscilla side of a bridge, Run returns once ctx is done
+type Priscilla interface {
+	Run(ctx context.Context, toPris <-chan *prisclient.Query,
+		fromPris chan<- *prisclient.Query)
+}
+
+// Engager is a Priscilla that tells when priscilla accepted the adapter, the
+// channel Engaged returns is closed then. Other implementations count as
+// engaged once a query comes from priscilla.
+type Engager interface {
+	Engaged() <-chan struct{}
+}
+
+// PriscillaClient runs a prisclient.Client, which can't be stopped. Once ctx
+// is done Run returns and leaves the client behind.
+type PriscillaClient struct {
+	*prisclient.Client
+}
+
+// engaged is what PriscillaClient reports, prisclient.NewClient returns once
+// the engage handshake succeeded
+var engaged = make(chan struct{})
+
+func init() {
+	close(engaged)
+}
+
+// Engaged is closed already, see Engager
+func (p PriscillaClient) Engaged() <-chan struct{} {
+	return engaged
+}
+
+// Run runs the client until ctx is done, see Priscilla
+func (p PriscillaClient) Run(ctx context.Context,
+	toPris <-chan *prisclient.Query, fromPris chan<- *prisclient.Query) {
+
+	go p.Client.Run(toPris, fromPris)
+	<-ctx.Done()
+}
+
+// Options configure a Bridge
+type Options struct {
+	Accounts  []Account
+	Priscilla Priscilla
+	// Logger is used by this package and the xmpp package, warnings go to
+	// stderr when nil
+	Logger *prislog.PrisLog
+	// Name and Version answer software version queries
+	Name    string
+	Version string
+	// ReadOnly bridges forward what they receive but only log what they
+	// would send and the rooms they would join or leave on request. The
+	// messages go to ShadowRoom instead, if set, an account qualified room
+	// name that's joined no matter the rooms of the account.
+	ReadOnly   bool
+	ShadowRoom string
+	// MaxFileSize limits the files shared, DefaultMaxFileSize when 0.
+	// Files can only be shared by path from within FileDir, not at all when
+	// it's empty.
+	MaxFileSize int64
+	FileDir     string
+	// Format converts what priscilla sends from Markdown, FormatNone when
+	// empty. RoomFormats overrides it by account qualified room name, and a
+	// message can pick its own with a first line like "/format html".
+	Format      string
+	RoomFormats map[string]string
+	// StripANSI removes the ANSI escape sequences, colors mostly, from what
+	// priscilla sends. Characters XML doesn't allow are dropped regardless.
+	StripANSI bool
+	// DropNotifications keeps the notifications integrations post in rooms
+	// from priscilla, they're forwarded as text otherwise
+	DropNotifications bool
+	// ShutdownTimeout is the time allowed for a graceful shutdown, 10
+	// seconds by default
+	ShutdownTimeout time.Duration
+
+	// OnMessage is called on the bridge loop for every message received,
+	// OnConnected and OnDisconnected on the goroutine of the account. None
+	// of them may block.
+	OnMessage      func(account string, msg *xmpp.Message)
+	OnConnected    func(account string)
+	OnDisconnected func(account string, err error)
+	// OnReload is called in a goroutine of its own when priscilla asks for
+	// a reload
+	OnReload func()
+}
+
+// Bridge passes messages between hipchat accounts and priscilla. A bridge
+// runs once, from Start until it stops.
+type Bridge struct {
+	opts       Options
+	clients    map[string]*client
+	prisStatus *priscillaStatus
+	requests   chan func()
+	shadow     *client
+	shadowRoom string
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+}
+
+// New creates a bridge for opts.Accounts, nothing is connected before Start
+func New(opts Options) (*Bridge, error) {
+	if len(opts.Accounts) == 0 {
+		return nil, errors.New("No hipchat account configured")
+	}
+	if opts.Priscilla == nil {
+		return nil, errors.New("No priscilla configured")
+	}
+	if opts.Name == "" {
+		opts.Name = "priscilla-hipchat"
+	}
+	if opts.MaxFileSize == 0 {
+		opts.MaxFileSize = DefaultMaxFileSize
+	}
+	if err := validFormat(opts.Format); err != nil {
+		return nil, err
+	}
+	for room, format := range opts.RoomFormats {
+		if err := validFormat(format); err != nil {
+			return nil, fmt.Errorf("%s: %s", room, err)
+		}
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = 10 * time.Second
+	}
+	if opts.Logger != nil {
+		SetLogger(opts.Logger)
+	}
+
+	b := &Bridge{
+		opts:       opts,
+		clients:    make(map[string]*client, len(opts.Accounts)),
+		prisStatus: &priscillaStatus{},
+		requests:   make(chan func()),
+		done:       make(chan struct{}),
+	}
+
+	for i := range opts.Accounts {
+		account := &opts.Accounts[i]
+		if _, exists := b.clients[account.Name]; exists {
+			return nil, fmt.Errorf("Duplicate account: %q", account.Name)
+		}
+		logging.Secrets.Add(account.Password)
+		b.clients[account.Name] = newClient(b, account)
+	}
+
+	if opts.ReadOnly && opts.ShadowRoom != "" {
+		b.shadow, b.shadowRoom = splitAccount(b.clients, opts.ShadowRoom)
+		if b.shadow == nil {
+			return nil, fmt.Errorf("No account found for shadow room: %s",
+				opts.ShadowRoom)
+		}
+	}
+
+	return b, nil
+}
+
+// Start connects the accounts and runs the bridge until ctx is done, Stop is
+// called, priscilla disengages or every account is finished
+func (b *Bridge) Start(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.started {
+		return errors.New("Bridge already started")
+	}
+	b.started = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	b.cancel = cancel
+
+	go func() {
+		err := b.run(ctx)
+		cancel()
+		b.mu.Lock()
+		b.err = err
+		b.mu.Unlock()
+		close(b.done)
+	}()
+
+	return nil
+}
+
+// Stop shuts the bridge down and waits for it, see Wait
+func (b *Bridge) Stop() error {
+	b.mu.Lock()
+	cancel := b.cancel
+	b.mu.Unlock()
+
+	if cancel == nil {
+		return ErrNotRunning
+	}
+	cancel()
+	return b.Wait()
+}
+
+// Wait waits for the bridge to stop and returns why it did, see ExitCode
+func (b *Bridge) Wait() error {
+	if !b.running() {
+		return ErrNotRunning
+	}
+	<-b.done
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Done is closed once the bridge stopped
+func (b *Bridge) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *Bridge) running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.started
+}
+
+// Do runs fn on the bridge loop, where it can't race with message handling,
+// and returns once fn did
+func (b *Bridge) Do(fn func()) error {
+	if !b.running() {
+		return ErrNotRunning
+	}
+
+	done := make(chan struct{})
+	select {
+	case b.requests <- func() {
+		fn()
+		close(done)
+	}:
+	case <-b.done:
+		return ErrNotRunning
+	}
+	<-done
+
+	return nil
+}
+
+// Configure changes the rooms and rate limit of a running account, joining
+// and leaving rooms as needed
+func (b *Bridge) Configure(account string, rooms map[string]bool,
+	rateLimit time.Duration) error {
+
+	c, ok := b.clients[account]
+	if !ok {
+		return fmt.Errorf("Unknown account: %q", account)
+	}
+
+	return b.Do(func() {
+		c.configure(rooms, rateLimit)
+	})
+}
+
+func (b *Bridge) connected(account string) {
+	if b.opts.OnConnected != nil {
+		b.opts.OnConnected(account)
+	}
+}
+
+func (b *Bridge) disconnected(account string, err error) {
+	if b.opts.OnDisconnected != nil {
+		b.opts.OnDisconnected(account, err)
+	}
+}
+
+// run passes messages between hipchat and priscilla until priscilla
+// disengages, the hipchat side finishes or ctx is done, then shuts down. The
+// returned error tells which, see ExitCode.
+func (b *Bridge) run(ctx context.Context) error {
+	clients := b.clients
+
+	// the priscilla side outlives ctx, the shutdown still talks to it
+	prisCtx, prisCancel := context.WithCancel(context.Background())
+	prisDone := make(chan struct{})
+	defer func() {
+		prisCancel()
+		<-prisDone
+	}()
+
+	messageFromHC := make(chan *accountMessage, queueSize)
+	connected := make(chan *client, len(clients))
+	for _, hc := range clients {
+		hc.start(ctx)
+		go hc.listen(messageFromHC, connected)
+	}
+
+	fromPris := make(chan *prisclient.Query, queueSize)
+	toPris := make(chan *prisclient.Query, queueSize)
+	// closed once the shutdown is out of time
+	expired := make(chan struct{})
+	report := reportTo(toPris, expired)
+	go func() {
+		b.opts.Priscilla.Run(prisCtx, toPris, fromPris)
+		close(prisDone)
+	}()
+
+	// without an Engager, hearing from priscilla is as good as it gets
+	var engage <-chan struct{}
+	engager, isEngager := b.opts.Priscilla.(Engager)
+	if isEngager {
+		engage = engager.Engaged()
+	}
+
+	queueDepth.collectWith(func() map[string]float64 {
+		return map[string]float64{
+			"from_hipchat":   float64(len(messageFromHC)),
+			"to_priscilla":   float64(len(toPris)),
+			"from_priscilla": float64(len(fromPris)),
+		}
+	})
+
+	loopCtx, loopCancel := context.WithCancel(ctx)
+	defer loopCancel()
+
+	// closed once every account is finished, e.g. a replay ended
+	finished := make(chan struct{})
+	go func() {
+		for _, hc := range clients {
+			<-hc.finished
+		}
+		close(finished)
+	}()
+
+	keepAlive := make(chan bool)
+	go keepAliveTrigger(loopCtx, keepAlive)
+
+	// the shutdown deadline runs from when ctx is done, a write stuck on a
+	// peer that stopped reading can't hold the loop up past it
+	stopAt := make(chan time.Time, 1)
+	go func() {
+		<-loopCtx.Done()
+		if ctx.Err() == nil {
+			return
+		}
+		deadline := time.Now().Add(b.opts.ShutdownTimeout)
+		setWriteDeadline(clients, deadline)
+		stopAt <- deadline
+	}()
+
+	var reason error
+
+mainLoop:
+	for {
+		select {
+		case am := <-messageFromHC:
+			hc, msg := am.client, am.msg
+			logging.Event(logger.Debug, "Message received", logging.Fields{
+				"direction": "in",
+				"account":   hc.account,
+				"type":      msg.Type,
+				"from":      msg.From,
+				"id":        msg.Id,
+				"body":      msg.Body,
+				"invite":    msg.RoomName,
+			})
+
+			if b.opts.OnMessage != nil {
+				b.opts.OnMessage(hc.account, msg)
+			}
+
+			fromSplit := strings.Split(msg.From, "/")
+			fromRoom := fromSplit[0]
+			var fromNick string
+			if len(fromSplit) > 1 {
+				fromNick = fromSplit[1]
+			}
+
+			if msg.FromJid != "" {
+				if _, exist := hc.knownUser(byJid, msg.FromJid); !exist {
+					// hc.xmpp.VCardRequest(hc.jid, msg.FromJid)
+					hc.populateUser(msg.FromJid)
+				}
+			}
+
+			roomName, _ := hc.roomName(fromRoom)
+
+			// integrations post notifications from the room itself
+			notification := msg.Body != "" &&
+				(msg.Notification() || fromNick == "")
+			// including the HTML the adapter sent as the nick
+			own := fromNick == hc.nick || notification && msg.Sender == hc.nick
+
+			if notification && b.opts.DropNotifications {
+				logging.Event(logger.Debug, "Notification dropped",
+					logging.Fields{
+						"account": hc.account,
+						"room":    roomName,
+						"sender":  msg.Sender,
+					})
+			} else if msg.Body != "" && !own {
+				body, from := msg.Body, fromNick
+				if msg.Format == "html" {
+					body = htmlText(msg.Body)
+				}
+				if notification && msg.Sender != "" {
+					from = msg.Sender
+				}
+
+				login := hc.login()
+				mentioned, err := regexp.MatchString("@"+login.mention, body)
+				if err != nil {
+					logger.Error.Println("Error searching for mention:", err)
+				}
+
+				stripped := strings.Replace(body, login.aMention, "", -1)
+
+				clientQuery := prisclient.Query{
+					Type: "message",
+					To:   "server",
+					Message: &prisclient.MessageBlock{
+						Message:   body,
+						From:      from,
+						Room:      hc.qualify(roomName),
+						Mentioned: mentioned,
+						Stripped:  stripped,
+					},
+				}
+
+				messagesReceived.inc(hc.account, roomName)
+
+				if mentioned {
+					mentions.inc(hc.account, roomName)
+					clientQuery.Message.Message = strings.Replace(body,
+						"@"+login.mention, "", -1)
+				}
+
+				if user, exists := hc.knownUser(byName, fromNick); exists &&
+					!notification {
+					clientQuery.Message.User = &prisclient.UserInfo{
+						Id:      user.Jid,
+						Name:    user.Name,
+						Mention: user.Mention,
+						Email:   user.Email,
+					}
+				}
+
+				toPris <- &clientQuery
+
+				if msg.File != nil {
+					toPris <- attachment(clientQuery.Message, msg.File)
+				}
+				if notification {
+					toPris <- notificationInfo(clientQuery.Message, msg)
+				}
+			} else if msg.RoomName != "" {
+				hc.addRoom(msg.RoomName, msg.From)
+				if hc.allowed(msg.RoomName) {
+					hc.join([]string{msg.From})
+				} else {
+					logger.Info.Println("Invited to", msg.RoomName,
+						"which is not in the rooms list, not joining")
+				}
+			}
+		case <-engage:
+			engage = nil
+			b.prisStatus.setEngaged(true)
+		case query := <-fromPris:
+			b.prisStatus.received()
+			logger.Debug.Println("Query received:", *query)
+			if !isEngager && !isDisengage(query) {
+				b.prisStatus.setEngaged(true)
+			}
+			switch {
+			case query.Type == "command":
+				if query.Command == nil {
+					logger.Error.Println("Command query without a command")
+					break
+				}
+				switch query.Command.Action {
+				case "disengage":
+					// either server forcing disengage or server connection lost
+					logger.Warn.Println("Disengage received, terminating...")
+					reason = ErrDisengaged
+					if !b.prisStatus.isEngaged() {
+						reason = ErrNotEngaged
+					}
+					b.prisStatus.setEngaged(false)
+					break mainLoop
+				case "reload":
+					if b.opts.OnReload != nil {
+						// it may call back into the loop, e.g. Configure
+						go b.opts.OnReload()
+					}
+				case "user_request", "room_request":
+					toPris <- info(clients, query)
+				case "share_file":
+					b.shareFile(query.Command, report)
+				default:
+					logger.Warn.Println("Ignoring unknown command:",
+						query.Command.Action)
+				}
+			case query.Type == "message":
+				if query.Message == nil {
+					logger.Error.Println("Message query without a message")
+					break
+				}
+				deliver(clients, query.Message, report)
+			}
+		case hc := <-connected:
+			hc.flush(report)
+		case request := <-b.requests:
+			request()
+		case <-finished:
+			if ctx.Err() != nil {
+				// the accounts finished because ctx is done
+				finished = nil
+				continue
+			}
+			if len(messageFromHC) > 0 {
+				// forward what the hipchat side left behind first
+				continue
+			}
+			logger.Info.Println("HipChat side finished, terminating...")
+			reason = ErrFinished
+			break mainLoop
+		case <-ctx.Done():
+			logger.Warn.Println("Stopping:", ctx.Err())
+			reason = ctx.Err()
+			break mainLoop
+		case <-keepAlive:
+			for _, hc := range clients {
+				hc.expire(report)
+				if conn := hc.conn(); conn != nil {
+					if err := conn.KeepAlive(); err != nil {
+						logger.Warn.Println("KeepAlive of account", hc.account,
+							"failed:", err)
+						continue
+					}
+					hc.ping()
+				}
+			}
+			logger.Debug.Println("KeepAlive sent")
+			// within 60 seconds of token expiration
+			// if hc.tokenExp < time.Now().Unix()+60 {
+			// if true {
+			//  hc.xmpp.AuthRequest(hc.username, hc.password, hc.resource)
+			//  logger.Info.Println("New token requested")
+			// }
+		}
+	}
+
+	loopCancel()
+
+	deadline := time.Now().Add(b.opts.ShutdownTimeout)
+	select {
+	case deadline = <-stopAt:
+	default:
+	}
+
+	expiry := time.AfterFunc(deadline.Sub(time.Now()), func() {
+		close(expired)
+	})
+	defer expiry.Stop()
+
+	clean := shutdown(clients, toPris, fromPris, report, deadline, expired,
+		reason == ErrDisengaged || reason == ErrNotEngaged)
+	return &stopError{reason: reason, unclean: !clean}
+}
+
+func isDisengage(query *prisclient.Query) bool {
+	return query.Type == "command" && query.Command != nil &&
+		query.Command.Action == "disengage"
+}
+
+func deliver(clients map[string]*client,
+	message *prisclient.MessageBlock, report failureReporter) {
+
+	hc, room := splitAccount(clients, message.Room)
+	if hc == nil {
+		logger.Error.Println("No account found for room:", message.Room)
+		return
+	}
+	routed := *message
+	routed.Room = room
+	hc.send(&routed, message.Room, report)
+}
+
+// attachment tells priscilla about the file shared with a message, there's
+// no room for it in the message itself
+func attachment(message *prisclient.MessageBlock,
+	file *xmpp.File) *prisclient.Query {
+
+	return &prisclient.Query{
+		Type: "command",
+		To:   "server",
+		Command: &prisclient.CommandBlock{
+			Id:     prisclient.RandomId(),
+			Action: "attachment",
+			Type:   "file",
+			Map: map[string]string{
+				"room":      message.Room,
+				"from":      message.From,
+				"message":   message.Message,
+				"name":      file.Name,
+				"size":      strconv.FormatInt(file.Size, 10),
+				"url":       file.Url,
+				"thumbnail": file.ThumbUrl,
+			},
+		},
+	}
+}
+
+// notificationInfo follows the message of a notification with what the
+// message block can't carry, the original markup first
+func notificationInfo(message *prisclient.MessageBlock,
+	msg *xmpp.Message) *prisclient.Query {
+
+	format := msg.Format
+	if format == "" {
+		format = "text"
+	}
+
+	return &prisclient.Query{
+		Type: "command",
+		To:   "server",
+		Command: &prisclient.CommandBlock{
+			Id:     prisclient.RandomId(),
+			Action: "notification",
+			Type:   format,
+			Map: map[string]string{
+				"room":    message.Room,
+				"from":    message.From,
+				"message": message.Message,
+				"body":    msg.Body,
+				"format":  format,
+				"color":   msg.Color,
+			},
+		},
+	}
+}
+
+// info answers a user_request or room_request
+func info(clients map[string]*client,
+	query *prisclient.Query) *prisclient.Query {
+
+	response := &prisclient.Query{
+		Type: "command",
+		To:   query.Source,
+		Command: &prisclient.CommandBlock{
+			Id:     query.Command.Id,
+			Action: "info",
+			Map:    map[string]string{},
+		},
+	}
+
+	if query.Command.Action == "user_request" {
+		response.Command.Type = "user"
+		userInfo(clients, query.Command, response.Command)
+	} else {
+		response.Command.Type = "room"
+		roomInfo(clients, query.Command, response.Command)
+	}
+
+	return response
+}
+
+func userInfo(clients map[string]*client,
+	request, response *prisclient.CommandBlock) {
+
+	switch request.Type {
+	case byName, byMention, byEmail, byJid:
+	default:
+		response.Error = fmt.Sprintf("Unknown user lookup type: %q",
+			request.Type)
+		return
+	}
+
+	candidates, data := lookupOrder(clients, request.Data)
+
+	for _, hc := range candidates {
+		if user, exists := hc.knownUser(request.Type, data); exists {
+			response.Map["id"] = user.Jid
+			response.Map["name"] = user.Name
+			response.Map["mention"] = user.Mention
+			response.Map["email"] = user.Email
+			if hc.account != "" {
+				response.Map["account"] = hc.account
+			}
+			return
+		}
+	}
+
+	response.Error = "User not found"
+}
+
+func roomInfo(clients map[string]*client,
+	request, response *prisclient.CommandBlock) {
+
+	switch request.Type {
+	case "name", "id":
+	default:
+		response.Error = fmt.Sprintf("Unknown room lookup type: %q",
+			request.Type)
+		return
+	}
+
+	candidates, data := lookupOrder(clients, request.Data)
+
+	for _, hc := range candidates {
+		switch request.Type {
+		case "name":
+			if id, exists := hc.roomId(data); exists {
+				response.Map["id"] = id
+				response.Map["name"] = hc.qualify(data)
+				return
+			}
+		case "id":
+			if name, exists := hc.roomName(data); exists {
+				response.Map["name"] = hc.qualify(name)
+				response.Map["id"] = data
+				return
+			}
+		}
+	}
+
+	response.Error = "Room not found"
+}
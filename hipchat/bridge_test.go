@@ -0,0 +1,348 @@
+package hipchat_test
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"github.com/priscillachat/priscilla-hipchat/hipchat/hipchattest"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	alice = xmpp.User{
+		Jid:     "1_3@chat.hipchat.com",
+		Name:    "Alice",
+		Mention: "alice",
+		Email:   "alice@example.com",
+	}
+	eng = xmpp.Room{Id: "1_eng@conf.hipchat.com", Name: "Eng"}
+)
+
+// testBridge is a bridge between a hipchattest.Server and a
+// hipchattest.Priscilla, connected and with the users known
+type testBridge struct {
+	*hipchat.Bridge
+	ctx      context.Context
+	p        *hipchattest.Priscilla
+	server   *hipchattest.Server
+	messages chan string
+	reloads  chan struct{}
+}
+
+func startBridge(t *testing.T) (*testBridge, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	tb := &testBridge{
+		ctx:      ctx,
+		p:        hipchattest.NewPriscilla(),
+		messages: make(chan string, 10),
+		reloads:  make(chan struct{}, 1),
+	}
+	tb.server = &hipchattest.Server{
+		Bot: xmpp.User{
+			Jid:     "1_2@chat.hipchat.com",
+			Name:    "Priscilla",
+			Mention: "priscilla",
+		},
+		Users: []xmpp.User{alice},
+		Rooms: []xmpp.Room{eng},
+		OnMessage: func(room, body string) {
+			tb.messages <- room + ": " + body
+		},
+	}
+
+	connected := make(chan struct{}, 1)
+	bridge, err := hipchat.New(hipchat.Options{
+		Accounts: []hipchat.Account{{
+			User:     "1_2",
+			Password: "secret",
+			Nick:     "Priscilla",
+			Dial:     tb.server.Dial,
+		}},
+		Priscilla: tb.p,
+		OnConnected: func(account string) {
+			connected <- struct{}{}
+		},
+		OnReload: func() {
+			tb.reloads <- struct{}{}
+		},
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.Bridge = bridge
+
+	if err := bridge.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		bridge.Stop()
+		bridge.Wait()
+		cancel()
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		stop()
+		t.Fatal("Not connected:", ctx.Err())
+	}
+
+	// the vCards of the users are pushed once the bot is available
+	for {
+		response := tb.request(t, "user_request", "id", alice.Jid)
+		if response.Error == "" {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			stop()
+			t.Fatal("Users not known:", ctx.Err())
+		}
+	}
+
+	return tb, stop
+}
+
+// request sends a command and returns the command of the response
+func (tb *testBridge) request(t *testing.T,
+	action, typ, data string) *prisclient.CommandBlock {
+
+	id, err := tb.p.Command(tb.ctx, action, typ, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := tb.p.Response(tb.ctx, id)
+	if err != nil {
+		t.Fatal("No response to", action+":", err)
+	}
+	return response.Command
+}
+
+func TestUserRequest(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	want := map[string]string{
+		"id":      alice.Jid,
+		"name":    alice.Name,
+		"mention": alice.Mention,
+		"email":   alice.Email,
+	}
+
+	for _, typ := range []string{"user", "mention", "email", "id"} {
+		data := want[typ]
+		if typ == "user" {
+			data = alice.Name
+		}
+
+		response := tb.request(t, "user_request", typ, data)
+		if response.Error != "" {
+			t.Errorf("%s %s: %s", typ, data, response.Error)
+			continue
+		}
+		if response.Type != "user" {
+			t.Errorf("%s: response type %q", typ, response.Type)
+		}
+		for key, value := range want {
+			if response.Map[key] != value {
+				t.Errorf("%s: %s is %q, want %q", typ, key,
+					response.Map[key], value)
+			}
+		}
+	}
+
+	response := tb.request(t, "user_request", "user", "Bob")
+	if response.Error != "User not found" {
+		t.Errorf("Unknown user: error %q", response.Error)
+	}
+
+	response = tb.request(t, "user_request", "nickname", alice.Name)
+	if response.Error != `Unknown user lookup type: "nickname"` {
+		t.Errorf("Unknown lookup type: error %q", response.Error)
+	}
+}
+
+func TestRoomRequest(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	response := tb.request(t, "room_request", "name", eng.Name)
+	if response.Error != "" || response.Map["id"] != eng.Id {
+		t.Errorf("By name: id %q, error %q", response.Map["id"],
+			response.Error)
+	}
+
+	response = tb.request(t, "room_request", "id", eng.Id)
+	if response.Error != "" || response.Map["name"] != eng.Name {
+		t.Errorf("By id: name %q, error %q", response.Map["name"],
+			response.Error)
+	}
+
+	response = tb.request(t, "room_request", "name", "Ops")
+	if response.Error != "Room not found" {
+		t.Errorf("Unknown room: error %q", response.Error)
+	}
+
+	response = tb.request(t, "room_request", "topic", eng.Name)
+	if response.Error != `Unknown room lookup type: "topic"` {
+		t.Errorf("Unknown lookup type: error %q", response.Error)
+	}
+}
+
+func TestDisengage(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	if _, err := tb.p.Command(tb.ctx, "disengage", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-tb.Done():
+	case <-tb.ctx.Done():
+		t.Fatal("Still running after disengage")
+	}
+
+	err := tb.Wait()
+	if code := hipchat.ExitCode(err); code != 3 {
+		t.Errorf("Exit code %d (%v), want 3", code, err)
+	}
+
+	// priscilla is gone, the bridge doesn't disengage in turn
+	for _, query := range tb.p.Queries() {
+		if query.Type == "command" && query.Command != nil &&
+			query.Command.Action == "disengage" {
+			t.Error("Disengaged from priscilla after disengage")
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	if _, err := tb.p.Command(tb.ctx, "reload", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-tb.reloads:
+	case <-tb.ctx.Done():
+		t.Fatal("OnReload not called")
+	}
+}
+
+func TestShareFile(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	err := tb.p.Send(tb.ctx, &prisclient.Query{
+		Type:   "command",
+		Source: "server",
+		Command: &prisclient.CommandBlock{
+			Action: "share_file",
+			Type:   "room",
+			Data:   eng.Name,
+			Map: map[string]string{
+				"name":    "report.txt",
+				"message": "Daily report",
+				"content": base64.StdEncoding.EncodeToString(
+					[]byte("all good")),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test server has no REST API, the start of the file is sent
+	// instead
+	select {
+	case message := <-tb.messages:
+		want := "Eng: Daily report\nreport.txt:\nall good"
+		if !strings.HasPrefix(message, want) {
+			t.Errorf("Sent %q, want %q", message, want)
+		}
+	case <-tb.ctx.Done():
+		t.Fatal("Nothing sent for the file")
+	}
+}
+
+func TestIgnoredCommands(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	id, err := tb.p.Command(tb.ctx, "dance", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a command query without its command block
+	err = tb.p.Send(tb.ctx, &prisclient.Query{
+		Type:   "command",
+		Source: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a message query without its message block
+	err = tb.p.Send(tb.ctx, &prisclient.Query{
+		Type:   "message",
+		Source: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still serving
+	response := tb.request(t, "room_request", "name", eng.Name)
+	if response.Error != "" {
+		t.Error("Room request after ignored commands:", response.Error)
+	}
+
+	for _, query := range tb.p.Queries() {
+		if query.Command != nil && query.Command.Id == id {
+			t.Error("Unknown command answered:", *query.Command)
+		}
+	}
+
+	select {
+	case <-tb.Done():
+		t.Error("Stopped:", tb.Wait())
+	default:
+	}
+}
+
+func TestOwnNotification(t *testing.T) {
+	tb, stop := startBridge(t)
+	defer stop()
+
+	// what the adapter sent as HTML comes back as a notification
+	err := tb.server.Notify("Priscilla", eng.Name, "html", "<b>own</b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tb.server.Notify("Jenkins", eng.Name, "html", "<b>build</b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := tb.p.Wait(tb.ctx, func(query *prisclient.Query) bool {
+		return query.Type == "message"
+	})
+	if err != nil {
+		t.Fatal("Nothing forwarded:", err)
+	}
+	if query.Message.From != "Jenkins" {
+		t.Errorf("Forwarded %q from %s", query.Message.Message,
+			query.Message.From)
+	}
+}
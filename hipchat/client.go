@@ -0,0 +1,846 @@
+// Package hipchat bridges hipchat accounts and priscilla. A Bridge is created
+// with New, started with Start and runs until it's stopped, priscilla
+// disengages or no account has anything left to connect to.
+package hipchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"github.com/priscillachat/prislog"
+	hcapi "github.com/tbruyelle/hipchat-go/hipchat"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hipchatHost = "chat.hipchat.com"
+	hipchatConf = "conf.hipchat.com"
+
+	// AccountSep separates the account from the room in room names on the
+	// priscilla side, "account:room"
+	AccountSep = ":"
+
+	queueSize = 100
+
+	reconnectDelay = 10 * time.Second
+)
+
+// ErrNoMoreConnections is returned by an Account's Dial when there's nothing
+// left to connect to, the account stops for good
+var ErrNoMoreConnections = errors.New("No more connections")
+
+// Account is a hipchat account the bridge connects with
+type Account struct {
+	// Name qualifies the rooms of the account as "name:room" on the
+	// priscilla side, empty for the default account
+	Name     string
+	User     string
+	Password string
+	Nick     string
+	// Rooms limits the rooms joined, all rooms are joined when nil
+	Rooms map[string]bool
+	// RateLimit is the minimum interval between messages sent
+	RateLimit time.Duration
+	// Taps get every stanza sent or received
+	Taps []xmpp.StanzaTap
+	// Dial opens the connection, to hipchat by default
+	Dial func() (*xmpp.Conn, error)
+	// ReconnectDelay is the wait between connection attempts, 10 seconds by
+	// default
+	ReconnectDelay time.Duration
+}
+
+// client is the connection of one account
+type client struct {
+	account  string
+	username string
+	password string
+	resource string
+	id       string
+	nick     string
+
+	// private
+	usersByMention map[string]*xmpp.User
+	usersByName    map[string]*xmpp.User
+	usersByJid     map[string]*xmpp.User
+	usersByEmail   map[string]*xmpp.User
+	xmpp           *xmpp.Conn
+	roomsByName    map[string]string
+	roomsById      map[string]string
+	host           string
+	info           *login
+	rooms          map[string]bool
+	joined         map[string]bool
+	dirMu          sync.RWMutex
+	rateLimit      time.Duration
+	lastSent       time.Time
+	ctx            context.Context
+	cancel         context.CancelFunc
+	connMu         sync.Mutex
+	status         connStatus
+	taps           []xmpp.StanzaTap
+	dial           func() (*xmpp.Conn, error)
+	retry          time.Duration
+	bridge         *Bridge
+	finished       chan struct{}
+	events         chan *xmpp.Event
+	outbox         []*queuedMessage
+	pacer          *time.Timer
+}
+
+// login is what the server told about a connection when logging in, it's
+// replaced as a whole on every reconnect
+type login struct {
+	jid       string
+	accountId string
+	apiHost   string
+	chatHost  string
+	mucHost   string
+	webHost   string
+	token     string
+	mention   string
+	aMention  string
+	api       *hcapi.Client
+}
+
+type accountMessage struct {
+	client *client
+	msg    *xmpp.Message
+}
+
+type message struct {
+	From        string
+	To          string
+	Body        string
+	MentionName string
+}
+
+var logger, _ = prislog.NewLogger(os.Stderr, "warn")
+
+// SetLogger sets the logger of the package and of the xmpp package, for
+// sessions opened with Connect. A bridge uses Options.Logger.
+func SetLogger(l *prislog.PrisLog) {
+	logger = l
+	xmpp.SetLogger(l)
+}
+
+func newClient(bridge *Bridge, account *Account) *client {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &client{
+		account:   account.Name,
+		username:  account.User,
+		password:  account.Password,
+		resource:  "bot",
+		id:        account.User + "@" + hipchatHost,
+		nick:      account.Nick,
+		rooms:     account.Rooms,
+		rateLimit: account.RateLimit,
+		taps:      account.Taps,
+		dial:      account.Dial,
+		retry:     account.ReconnectDelay,
+		bridge:    bridge,
+
+		xmpp:           nil,
+		usersByMention: make(map[string]*xmpp.User),
+		usersByJid:     make(map[string]*xmpp.User),
+		usersByName:    make(map[string]*xmpp.User),
+		usersByEmail:   make(map[string]*xmpp.User),
+		host:           hipchatHost,
+		info:           &login{},
+		roomsByName:    make(map[string]string),
+		roomsById:      make(map[string]string),
+		joined:         make(map[string]bool),
+		ctx:            ctx,
+		cancel:         cancel,
+		finished:       make(chan struct{}),
+	}
+
+	if c.dial == nil {
+		c.dial = func() (*xmpp.Conn, error) {
+			return xmpp.Dial(hipchatHost)
+		}
+	}
+	if c.retry == 0 {
+		c.retry = reconnectDelay
+	}
+
+	return c
+}
+
+// start ties the client to ctx, cancelling it stops the client just like
+// close does
+func (c *client) start(ctx context.Context) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+}
+
+func (c *client) isShadow(name string) bool {
+	return c.bridge.shadow == c && c.bridge.shadowRoom == name
+}
+
+// readOnly tells whether the bridge is read-only, what would have been done
+// is logged
+func (c *client) readOnly(action string, rooms []string) bool {
+	if !c.bridge.opts.ReadOnly || len(rooms) == 0 {
+		return c.bridge.opts.ReadOnly
+	}
+
+	names := make([]string, 0, len(rooms))
+	for _, id := range rooms {
+		name, _ := c.roomName(id)
+		names = append(names, name)
+	}
+	logging.Event(logger.Info, "Read-only, not "+action, logging.Fields{
+		"account": c.account,
+		"rooms":   strings.Join(names, ","),
+	})
+	return true
+}
+
+// configure applies the live settings of the client, joining and leaving
+// rooms right away if connected
+func (c *client) configure(rooms map[string]bool,
+	rateLimit time.Duration) {
+
+	c.setRooms(rooms)
+	c.rateLimit = rateLimit
+
+	if c.conn() == nil || c.login().jid == "" {
+		return
+	}
+
+	var join, leave []string
+
+	for _, room := range c.roomList() {
+		switch allowed, joined := c.allowed(room.Name), c.isJoined(room.Id); {
+		case allowed && !joined:
+			join = append(join, room.Id)
+		case !allowed && joined:
+			leave = append(leave, room.Id)
+		}
+	}
+
+	if c.bridge.opts.ReadOnly {
+		c.readOnly("joining", join)
+		c.readOnly("leaving", leave)
+		return
+	}
+
+	c.join(join)
+	c.leave(leave)
+}
+
+func (c *client) join(rooms []string) {
+	if len(rooms) == 0 {
+		return
+	}
+	if err := c.conn().Join(c.login().jid, c.nick, rooms); err != nil {
+		logger.Error.Println("Failed to join rooms:", err)
+		return
+	}
+	c.setJoined(rooms, true)
+}
+
+func (c *client) leave(rooms []string) {
+	if len(rooms) == 0 {
+		return
+	}
+	if err := c.conn().Leave(c.login().jid, c.nick, rooms); err != nil {
+		logger.Error.Println("Failed to leave rooms:", err)
+	}
+	c.setJoined(rooms, false)
+}
+
+// qualify prefixes a room name with the account name, so rooms of different
+// accounts can be told apart on the priscilla side
+func (c *client) qualify(name string) string {
+	if c.account == "" {
+		return name
+	}
+	return c.account + AccountSep + name
+}
+
+// splitAccount resolves an account qualified identifier into the client it
+// belongs to and the unqualified identifier. Unqualified identifiers belong
+// to the default (unnamed) account, if there is one.
+func splitAccount(clients map[string]*client,
+	id string) (*client, string) {
+
+	if idx := strings.Index(id, AccountSep); idx > 0 {
+		if c, ok := clients[id[:idx]]; ok {
+			return c, id[idx+len(AccountSep):]
+		}
+	}
+
+	return clients[""], id
+}
+
+// lookupOrder returns the clients to search for an identifier, the one the
+// identifier is qualified with, or all of them in account name order
+func lookupOrder(clients map[string]*client,
+	id string) ([]*client, string) {
+
+	if idx := strings.Index(id, AccountSep); idx > 0 {
+		if c, ok := clients[id[:idx]]; ok {
+			return []*client{c}, id[idx+len(AccountSep):]
+		}
+	}
+
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ordered := make([]*client, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, clients[name])
+	}
+	return ordered, id
+}
+
+// initialize negotiates TLS and logs in. Anything the server sends that's not
+// part of that is skipped.
+func (c *client) initialize() error {
+	c.xmpp.SetLoginDeadline(time.Now().Add(xmpp.LoginTimeout))
+	defer c.xmpp.SetLoginDeadline(time.Time{})
+
+	c.xmpp.StreamStart(c.id, c.host)
+	for {
+		element, err := c.xmpp.RecvNext()
+
+		if err != nil {
+			return err
+		}
+
+		switch element.Name.Local + element.Name.Space {
+		case "stream" + xmpp.NsStream:
+			// the features follow
+		case "features" + xmpp.NsStream:
+			var features xmpp.Features
+			if err := c.xmpp.DecodeElement(&features, &element); err != nil {
+				return err
+			}
+			if features.StartTLS != nil {
+				c.xmpp.StartTLS()
+			} else {
+				err := c.xmpp.AuthRequest(c.username, c.password, c.resource)
+				if err != nil {
+					return err
+				}
+			}
+		case "proceed" + xmpp.NsTLS:
+			c.xmpp.UseTLS(c.host)
+			c.xmpp.StreamStart(c.id, c.host)
+		case "success" + xmpp.NsAuth, "success" + xmpp.NsHipchat:
+			var info xmpp.AuthResponse
+			if err := c.xmpp.DecodeElement(&info, &element); err != nil {
+				return err
+			}
+			login := &login{
+				jid:       info.Jid,
+				accountId: strings.Split(info.Jid, "_")[0],
+				apiHost:   info.ApiHost,
+				chatHost:  info.ChatHost,
+				mucHost:   info.MucHost,
+				webHost:   info.WebHost,
+				token:     info.Token,
+			}
+			if login.token != "" {
+				login.api = hcapi.NewClient(login.token)
+			}
+			c.setLogin(login)
+			logging.Secrets.Add(info.Token)
+			logger.Debug.Println("JID:", login.jid)
+			return nil
+		case "failure" + xmpp.NsAuth, "failure" + xmpp.NsHipchat:
+			c.xmpp.Skip()
+			return errors.New("Authentication failed")
+		default:
+			logger.Debug.Println("Skipping", element.Name.Local,
+				"during login")
+			if err := c.xmpp.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// lookupUser looks a user up through the REST API, by id, email or @mention
+func (c *client) lookupUser(id string) (*xmpp.User, error) {
+	api := c.login().api
+	if api == nil {
+		return nil, errors.New("No REST API client")
+	}
+
+	user, _, err := api.User.View(id)
+	userLookups.inc(c.account)
+
+	if err != nil {
+		userLookupFailures.inc(c.account)
+		return nil, err
+	}
+
+	logger.Debug.Println("User found:", user)
+	return &xmpp.User{
+		Jid:     user.XmppJid,
+		Name:    user.Name,
+		Mention: user.MentionName,
+		Email:   user.Email,
+	}, nil
+}
+
+// fetchUser looks the user with the given jid up through the REST API
+func (c *client) fetchUser(jid string) (*xmpp.User, error) {
+	idFull := strings.Split(jid, "@")[0]
+	parts := strings.Split(idFull, "_")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Unexpected user jid: %s", jid)
+	}
+	return c.lookupUser(parts[1])
+}
+
+func (c *client) populateUser(jid string) error {
+	hcUser, err := c.fetchUser(jid)
+	if err != nil {
+		return err
+	}
+
+	c.addUser(hcUser)
+
+	return nil
+}
+
+// groupMessage sends a message to a room, or to the shadow room of a
+// read-only bridge. A notification goes out on its own, its failure is
+// reported later.
+func (c *client) groupMessage(q *queuedMessage, report failureReporter) error {
+	message := q.message
+	format, body := c.format(message)
+
+	if format == FormatHTML && c.login().api == nil {
+		logger.Warn.Println("No REST API client for HTML, sending text to",
+			c.qualify(message.Room))
+		format = FormatText
+	}
+
+	formatted := *message
+	switch format {
+	case FormatText:
+		formatted.Message = markdownText(body)
+	case FormatHTML:
+		formatted.Message = markdownHTML(body)
+	default:
+		formatted.Message = body
+	}
+
+	if !c.bridge.opts.ReadOnly {
+		if format == FormatHTML {
+			c.notify(&formatted, q, report)
+			return nil
+		}
+		return c.post(&formatted)
+	}
+
+	logging.Event(logger.Info, "Read-only, not sent", logging.Fields{
+		"account": c.account,
+		"room":    message.Room,
+		"format":  format,
+		"body":    formatted.Message,
+	})
+
+	if c.bridge.shadow == nil {
+		return nil
+	}
+
+	// nobody gets notified from the shadow room
+	if format == FormatHTML {
+		formatted.Message = markdownText(body)
+	}
+	return c.bridge.shadow.post(&prisclient.MessageBlock{
+		Room:    c.bridge.shadowRoom,
+		Message: "[" + c.qualify(message.Room) + "] " + formatted.Message,
+	})
+}
+
+// holdBack returns how long the rate limit of the account holds the next
+// message back
+func (c *client) holdBack() time.Duration {
+	if c.rateLimit <= 0 {
+		return 0
+	}
+	return c.lastSent.Add(c.rateLimit).Sub(time.Now())
+}
+
+func (c *client) post(message *prisclient.MessageBlock) error {
+	c.lastSent = time.Now()
+	roomId, _ := c.roomId(message.Room)
+
+	xmppMsg := xmpp.Message{
+		From: c.login().jid,
+		To:   roomId + "/" + c.nick,
+		Id:   prisclient.RandomId(),
+		Type: "groupchat",
+		Body: c.sanitize(message),
+	}
+
+	if len(message.MentionNotify) > 0 {
+		for _, name := range message.MentionNotify {
+			if user, ok := c.knownUser(byName, name); ok {
+				xmppMsg.Body += " @" + user.Mention
+			}
+		}
+	}
+
+	logging.Event(logger.Debug, "Message sent", logging.Fields{
+		"direction": "out",
+		"account":   c.account,
+		"room":      message.Room,
+		"id":        xmppMsg.Id,
+	})
+
+	conn := c.conn()
+	if conn == nil {
+		return xmpp.ErrNotConnected
+	}
+
+	if err := conn.Encode(&xmppMsg); err != nil {
+		return err
+	}
+
+	messagesSent.inc(c.account, message.Room)
+	return nil
+}
+
+// notify sends the HTML of message as a notification through the REST API,
+// mentions in it notify nobody. The request runs on its own, a failure is
+// reported from the bridge loop.
+func (c *client) notify(message *prisclient.MessageBlock, q *queuedMessage,
+	report failureReporter) {
+
+	c.lastSent = time.Now()
+
+	logging.Event(logger.Debug, "Notification sent", logging.Fields{
+		"direction": "out",
+		"account":   c.account,
+		"room":      message.Room,
+	})
+
+	api := c.login().api
+	request := &hcapi.NotificationRequest{
+		Message:       c.sanitize(message),
+		MessageFormat: "html",
+		From:          c.nick,
+	}
+
+	go func() {
+		_, err := api.Room.Notification(message.Room, request)
+		if err == nil {
+			messagesSent.inc(c.account, message.Room)
+			return
+		}
+
+		err = c.bridge.Do(func() {
+			c.failed(q, err.Error(), report)
+		})
+		if err != nil {
+			logger.Error.Println("Failed to report the notification to",
+				q.room+":", err)
+		}
+	}()
+}
+
+// conn returns the current connection. It's replaced by the listen goroutine
+// on reconnect, other goroutines go through here.
+func (c *client) conn() *xmpp.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.xmpp
+}
+
+// login returns what's known about the current connection, it's replaced
+// like the connection
+func (c *client) login() *login {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.info
+}
+
+func (c *client) setLogin(login *login) {
+	c.connMu.Lock()
+	c.info = login
+	c.connMu.Unlock()
+}
+
+func (c *client) establishConnection() error {
+	conn, err := c.dial()
+
+	if conn == nil {
+		conn = xmpp.NewConn(nil)
+	}
+
+	c.connMu.Lock()
+	c.xmpp = conn
+	c.connMu.Unlock()
+
+	if err != nil {
+		logger.Error.Println("Error connecting to hipchat:", err)
+		return err
+	}
+
+	if logging.Level(logger) == "debug" {
+		c.xmpp.Tap(debugTap(c.account))
+	}
+	for _, tap := range c.taps {
+		c.xmpp.Tap(tap)
+	}
+
+	logger.Info.Println("Connected to HipChat")
+
+	err = c.initialize()
+
+	if err != nil {
+		logger.Error.Println("Failed to initialize HipChat connection:", err)
+		return err
+	}
+	logger.Info.Println("Authenticated")
+
+	c.xmpp.Handle(xmpp.NsPing, "ping",
+		func(iq *xmpp.IncomingIq) (interface{}, error) {
+			return nil, nil
+		})
+	c.xmpp.HandleVersion(c.bridge.opts.Name, c.bridge.opts.Version)
+	c.xmpp.HandleDisco(c.nick, xmpp.NsMuc)
+
+	c.xmpp.StartWriter()
+
+	c.events = make(chan *xmpp.Event, queueSize)
+	go c.xmpp.Route(c.events)
+
+	ctx, cancel := context.WithTimeout(c.ctx, xmpp.IqTimeout)
+	defer cancel()
+
+	login := *c.login()
+	self, err := c.xmpp.VCard(ctx, login.jid, "")
+
+	if err != nil {
+		logger.Error.Println("Failed to retrieve info on myself:", err)
+		return err
+	}
+
+	login.mention = self.Mention
+	login.aMention = "@" + self.Mention
+	c.setLogin(&login)
+
+	c.updateUserInfo(self)
+
+	rooms, err := c.xmpp.Discover(ctx, login.jid, login.mucHost)
+
+	if err != nil {
+		logger.Error.Println("Failed to discover rooms:", err)
+		return err
+	}
+
+	autojoin := make([]string, 0, len(rooms))
+	c.resetJoined()
+
+	for _, room := range rooms {
+		c.addRoom(room.Name, room.Id)
+		if c.allowed(room.Name) {
+			autojoin = append(autojoin, room.Id)
+		}
+	}
+
+	c.join(autojoin)
+
+	return c.xmpp.Available(login.jid)
+}
+
+// connect keeps trying to establish the connection until it succeeds or the
+// client is closed, returns false in the latter case
+func (c *client) connect() bool {
+	for {
+		c.setState(stateConnecting)
+		reconnects.inc(c.account)
+
+		err := c.establishConnection()
+
+		if err == nil {
+			c.setState(stateConnected)
+			return true
+		}
+
+		c.setState(stateDisconnected)
+
+		if err == ErrNoMoreConnections {
+			logger.Info.Println("No more connections for account", c.account)
+			return false
+		}
+
+		logger.Error.Println("Failed to establish connection with hipchat:",
+			err)
+		logger.Warn.Println("Sleeping", c.retry, "before retry...")
+		if c.xmpp != nil {
+			c.xmpp.Disconnect()
+		}
+
+		start := time.Now()
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(c.retry):
+		}
+		reconnectBackoff.observeDuration(time.Since(start), c.account)
+	}
+}
+
+func (c *client) setState(state int) {
+	connectionState.set(float64(state), c.account)
+	c.status.setState(state)
+	if state == stateConnected {
+		c.status.setJid(c.login().jid)
+		c.status.setJoined(len(c.joinedRooms()))
+	}
+}
+
+// listen reads from the connection and reconnects when it fails, connected is
+// told once the rooms are (re)joined
+func (c *client) listen(msgChan chan<- *accountMessage,
+	connected chan<- *client) {
+
+	defer close(c.finished)
+
+	if !c.connect() {
+		return
+	}
+	c.bridge.connected(c.account)
+	select {
+	case connected <- c:
+	case <-c.ctx.Done():
+		return
+	}
+
+	for {
+		var event *xmpp.Event
+		select {
+		case event = <-c.events:
+		case <-c.ctx.Done():
+			return
+		}
+
+		if event.Err != nil {
+			if c.closing() {
+				return
+			}
+			logger.Error.Println(event.Err)
+			c.setState(stateDisconnected)
+			c.xmpp.Disconnect()
+			c.bridge.disconnected(c.account, event.Err)
+
+			if !c.connect() {
+				return
+			}
+			c.bridge.connected(c.account)
+			select {
+			case connected <- c:
+			case <-c.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		c.status.received()
+
+		switch {
+		case event.Message != nil:
+			select {
+			case msgChan <- &accountMessage{client: c, msg: event.Message}:
+			case <-c.ctx.Done():
+				return
+			}
+
+			logger.Debug.Println(*event.Message)
+		case event.Iq != nil:
+			c.handleIq(event.Iq)
+		}
+	}
+}
+
+// handleIq deals with an iq that's not a reply to one of our requests
+func (c *client) handleIq(iq *xmpp.IncomingIq) {
+	var card xmpp.Card
+	if err := iq.DecodePayload(&card); err == nil && card.Nickname != "" {
+		c.updateUserInfo(&xmpp.User{
+			Jid:     iq.From,
+			Name:    card.Name,
+			Mention: card.Nickname,
+			Email:   card.Email,
+		})
+		return
+	}
+
+	logger.Debug.Println("Ignoring iq", iq.Type, iq.Id, "from", iq.From)
+}
+
+// ping sends a keepalive ping, its round trip time is measured once the
+// answer arrives
+func (c *client) ping() {
+	jid := c.login().jid
+	if jid == "" {
+		return
+	}
+
+	conn := c.conn()
+	sent := time.Now()
+	pending, err := conn.Ping(jid, c.host)
+	if err != nil {
+		logger.Error.Println("Failed to send ping:", err)
+		c.dropConnection(conn)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(c.ctx, xmpp.IqTimeout)
+		defer cancel()
+
+		if err := pending.Wait(ctx, nil); err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			logger.Warn.Println("Ping of account", c.account, "failed:", err)
+			c.dropConnection(conn)
+			return
+		}
+		keepAliveRTT.observeDuration(time.Since(sent), c.account)
+	}()
+}
+
+// dropConnection gives up on a connection that stopped answering, e.g. half
+// open, listen notices and reconnects
+func (c *client) dropConnection(conn *xmpp.Conn) {
+	c.setState(stateDisconnected)
+	conn.Disconnect()
+}
+
+func debugTap(account string) xmpp.StanzaTap {
+	return func(direction, stanza string) {
+		logging.Event(logger.Debug, "Raw", logging.Fields{
+			"account":   account,
+			"direction": direction,
+			"stanza":    stanza,
+		})
+	}
+}
+
+func (c *client) updateUserInfo(info *xmpp.User) {
+	c.addUser(info)
+
+	logger.Debug.Println("User info obtained:", *info)
+}
@@ -0,0 +1,157 @@
+package hipchat
+
+import (
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"sort"
+)
+
+// The rooms and users of an account are filled in on the listen goroutine,
+// on (re)connect and as vCards come in, and used on the bridge loop. dirMu
+// guards them, along with the rooms the account is configured for.
+
+// ways to look a known user up
+const (
+	byName    = "user"
+	byMention = "mention"
+	byEmail   = "email"
+	byJid     = "id"
+)
+
+func (c *client) addUser(user *xmpp.User) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+
+	c.usersByMention[user.Mention] = user
+	c.usersByName[user.Name] = user
+	c.usersByJid[user.Jid] = user
+	c.usersByEmail[user.Email] = user
+}
+
+// knownUser looks a user up by name, mention, email or jid
+func (c *client) knownUser(by, key string) (*xmpp.User, bool) {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	var users map[string]*xmpp.User
+	switch by {
+	case byName:
+		users = c.usersByName
+	case byMention:
+		users = c.usersByMention
+	case byEmail:
+		users = c.usersByEmail
+	case byJid:
+		users = c.usersByJid
+	}
+
+	user, ok := users[key]
+	return user, ok
+}
+
+func (c *client) userList() []*xmpp.User {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	users := make([]*xmpp.User, 0, len(c.usersByJid))
+	for _, user := range c.usersByJid {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (c *client) addRoom(name, id string) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+
+	c.roomsByName[name] = id
+	c.roomsById[id] = name
+}
+
+func (c *client) roomId(name string) (string, bool) {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	id, ok := c.roomsByName[name]
+	return id, ok
+}
+
+func (c *client) roomName(id string) (string, bool) {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	name, ok := c.roomsById[id]
+	return name, ok
+}
+
+// roomList returns the rooms discovered, by name
+func (c *client) roomList() []xmpp.Room {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	names := make([]string, 0, len(c.roomsByName))
+	for name := range c.roomsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rooms := make([]xmpp.Room, 0, len(names))
+	for _, name := range names {
+		rooms = append(rooms, xmpp.Room{Id: c.roomsByName[name], Name: name})
+	}
+	return rooms
+}
+
+func (c *client) isJoined(id string) bool {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	return c.joined[id]
+}
+
+func (c *client) joinedRooms() []string {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	rooms := make([]string, 0, len(c.joined))
+	for room := range c.joined {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// setJoined marks rooms as joined or left
+func (c *client) setJoined(rooms []string, joined bool) {
+	c.dirMu.Lock()
+	for _, room := range rooms {
+		if joined {
+			c.joined[room] = true
+		} else {
+			delete(c.joined, room)
+		}
+	}
+	count := len(c.joined)
+	c.dirMu.Unlock()
+
+	c.status.setJoined(count)
+}
+
+// resetJoined forgets the rooms joined, on a new connection
+func (c *client) resetJoined() {
+	c.dirMu.Lock()
+	c.joined = make(map[string]bool)
+	c.dirMu.Unlock()
+}
+
+func (c *client) setRooms(rooms map[string]bool) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+
+	c.rooms = rooms
+}
+
+func (c *client) allowed(name string) bool {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+
+	return c.rooms == nil || c.rooms[name] || c.isShadow(name)
+}
@@ -0,0 +1,300 @@
+package hipchat
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/prisclient"
+	hcapi "github.com/tbruyelle/hipchat-go/hipchat"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxFileSize is the size limit of files shared when none is set
+	DefaultMaxFileSize = 10 << 20
+
+	// how much of a text file is sent instead when it can't be shared
+	snippetSize = 1000
+)
+
+// fileShare is a file priscilla asked to share, in a room or with a user
+type fileShare struct {
+	client  *client
+	target  string
+	room    bool
+	name    string
+	path    string
+	temp    bool
+	message string
+	size    int64
+	// the start of the file, for the fallback
+	head []byte
+}
+
+// shareFile handles a share_file command. The upload runs on its own, when
+// it fails the message is sent along with a snippet of the file instead.
+func (b *Bridge) shareFile(command *prisclient.CommandBlock,
+	report failureReporter) {
+
+	share, err := b.prepareShare(command)
+	if err != nil {
+		logger.Error.Println("Not sharing file:", err)
+		if share == nil {
+			report(command.Data, command.Map["message"], err.Error())
+			return
+		}
+		b.fileFallback(share, err, report)
+		return
+	}
+
+	if b.opts.ReadOnly {
+		logging.Event(logger.Info, "Read-only, not shared", logging.Fields{
+			"account": share.client.account,
+			"target":  share.target,
+			"file":    share.name,
+		})
+		share.cleanup()
+		return
+	}
+
+	api := share.client.login().api
+	if api == nil {
+		b.fileFallback(share, errors.New("No REST API client"), report)
+		return
+	}
+
+	go func() {
+		defer share.cleanup()
+
+		request := &hcapi.ShareFileRequest{
+			Path:     share.path,
+			Filename: share.name,
+			Message:  share.message,
+		}
+
+		var err error
+		if share.room {
+			_, err = api.Room.ShareFile(share.target, request)
+		} else {
+			_, err = api.User.ShareFile(share.target, request)
+		}
+
+		if err != nil {
+			logger.Error.Println("Failed to share file", share.name+":", err)
+			filesFailed.inc(share.client.account)
+			b.Do(func() {
+				b.fileFallback(share, err, report)
+			})
+			return
+		}
+		filesShared.inc(share.client.account)
+	}()
+}
+
+// prepareShare resolves the target of the command and gets the file ready for
+// upload. When the file is fine but can't be uploaded, the share is returned
+// along with the error, for the fallback.
+func (b *Bridge) prepareShare(
+	command *prisclient.CommandBlock) (*fileShare, error) {
+
+	hc, target := splitAccount(b.clients, command.Data)
+	if hc == nil {
+		return nil, fmt.Errorf("No account found for %s", command.Data)
+	}
+
+	share := &fileShare{
+		client:  hc,
+		target:  target,
+		name:    command.Map["name"],
+		message: command.Map["message"],
+	}
+
+	switch command.Type {
+	case "room":
+		if _, ok := hc.roomId(target); !ok {
+			return nil, fmt.Errorf("Room not found: %s", command.Data)
+		}
+		share.room = true
+	case "user":
+		// the REST API takes an id, an email or an @mention
+		if user, ok := hc.knownUser(byName, target); ok {
+			share.target = "@" + user.Mention
+		}
+	default:
+		return nil, fmt.Errorf("Unknown share target type: %q", command.Type)
+	}
+
+	var err error
+
+	switch {
+	case command.Map["content"] != "":
+		if share.name == "" {
+			return nil, errors.New("No file name given")
+		}
+		err = share.writeTemp(command.Map["content"], b.opts.MaxFileSize)
+	case command.Map["path"] != "":
+		err = share.open(b.opts.FileDir, command.Map["path"])
+	default:
+		err = errors.New("Neither content nor path given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if share.size > b.opts.MaxFileSize {
+		return share, fmt.Errorf("File of %d bytes exceeds the limit of %d",
+			share.size, b.opts.MaxFileSize)
+	}
+
+	return share, nil
+}
+
+// writeTemp puts inline content, base64 encoded, into a temporary file.
+// Content decoding to more than limit is refused before it's decoded.
+func (s *fileShare) writeTemp(content string, limit int64) error {
+	size := int64(base64.StdEncoding.DecodedLen(len(content)))
+	if size > limit {
+		return fmt.Errorf("File of up to %d bytes exceeds the limit of %d",
+			size, limit)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return fmt.Errorf("Invalid file content: %s", err)
+	}
+
+	f, err := ioutil.TempFile("", "priscilla-hipchat-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.path, s.temp = f.Name(), true
+	if _, err := f.Write(data); err != nil {
+		s.cleanup()
+		return err
+	}
+
+	s.size = int64(len(data))
+	// a copy, so the content isn't kept around for the fallback
+	head := data
+	if len(head) > snippetSize {
+		head = head[:snippetSize]
+	}
+	s.head = append([]byte(nil), head...)
+	return nil
+}
+
+// open checks a local file, which has to be in dir once symlinks are
+// resolved
+func (s *fileShare) open(dir, path string) error {
+	if dir == "" {
+		return errors.New("Sharing files by path is disabled")
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(realDir, realPath)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", path, dir)
+	}
+
+	f, err := os.Open(realPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	head := make([]byte, snippetSize)
+	n, _ := f.Read(head)
+	s.head = head[:n]
+
+	s.path = realPath
+	s.size = info.Size()
+	if s.name == "" {
+		s.name = filepath.Base(path)
+	}
+	return nil
+}
+
+func (s *fileShare) cleanup() {
+	if s.temp {
+		os.Remove(s.path)
+	}
+}
+
+// textSnippet returns head as text, unless it's binary. A character cut off
+// at the end doesn't count.
+func textSnippet(head []byte) (string, bool) {
+	for cut := 0; cut < utf8.UTFMax && cut <= len(head); cut++ {
+		text := head[:len(head)-cut]
+		if utf8.Valid(text) {
+			return string(text), !strings.ContainsRune(string(text), 0)
+		}
+	}
+	return "", false
+}
+
+// fileFallback sends the message of a share that failed to a room, with a
+// snippet of the file if it's text. Users can only be told about it through
+// priscilla.
+func (b *Bridge) fileFallback(share *fileShare, cause error,
+	report failureReporter) {
+
+	defer share.cleanup()
+
+	qualified := share.client.qualify(share.target)
+	if !share.room {
+		report(qualified, share.message, "File share failed: "+cause.Error())
+		return
+	}
+
+	text := share.message
+	if text != "" {
+		text += "\n"
+	}
+
+	if snippet, ok := textSnippet(share.head); ok {
+		text += share.name + ":\n" + snippet
+		if int64(len(share.head)) < share.size {
+			text += "\n(truncated)"
+		}
+	} else {
+		text += "(" + share.name + " could not be shared)"
+	}
+
+	share.client.send(&prisclient.MessageBlock{
+		Room:    share.target,
+		Message: text,
+	}, qualified, report)
+}
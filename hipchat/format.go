@@ -0,0 +1,313 @@
+package hipchat
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/priscillachat/prisclient"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Formats of the messages sent, what priscilla sends is taken as Markdown
+const (
+	// FormatNone sends messages as they are
+	FormatNone = "none"
+	// FormatText follows the plain text conventions of HipChat, over XMPP
+	FormatText = "text"
+	// FormatHTML sends HTML notifications through the REST API
+	FormatHTML = "html"
+)
+
+var (
+	// a message picks its own format on its first line
+	formatDirective = regexp.MustCompile(`^/format (none|text|html)(?: |\n|$)`)
+
+	mdFence   = regexp.MustCompile("^\\s*```")
+	mdHeading = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	mdBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumber  = regexp.MustCompile(`^\s*(\d+)[.)]\s+(.*)$`)
+	mdQuote   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	mdInline  = regexp.MustCompile("`([^`]+)`" +
+		`|(!?)\[([^\]]*)\]\(([^)\s]+)\)` +
+		`|\*\*([^*]+)\*\*|__([^_]+)__` +
+		`|\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	emoticon = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+)
+
+// the emoji shortcodes common in Markdown that HipChat has an emoticon for
+var emoticons = map[string]string{
+	":smile:":            ":)",
+	":smiley:":           ":D",
+	":grinning:":         ":D",
+	":wink:":             ";)",
+	":disappointed:":     ":(",
+	":frowning:":         ":(",
+	":stuck_out_tongue:": ":p",
+	":+1:":               "(thumbsup)",
+	":thumbsup:":         "(thumbsup)",
+	":-1:":               "(thumbsdown)",
+	":thumbsdown:":       "(thumbsdown)",
+	":white_check_mark:": "(successful)",
+	":heavy_check_mark:": "(successful)",
+	":x:":                "(failed)",
+	":tada:":             "(yey)",
+	":coffee:":           "(coffee)",
+}
+
+func validFormat(format string) error {
+	switch format {
+	case "", FormatNone, FormatText, FormatHTML:
+		return nil
+	}
+	return fmt.Errorf("Unknown format: %q", format)
+}
+
+// format picks the format of message, its own first, then the one of its
+// room, then the default, and returns the body without the directive
+func (c *client) format(message *prisclient.MessageBlock) (string, string) {
+	body := message.Message
+
+	if m := formatDirective.FindStringSubmatch(body); m != nil {
+		return m[1], body[len(m[0]):]
+	}
+
+	opts := &c.bridge.opts
+	if format, ok := opts.RoomFormats[c.qualify(message.Room)]; ok {
+		return format, body
+	}
+	if opts.Format != "" {
+		return opts.Format, body
+	}
+	return FormatNone, body
+}
+
+// markdownText converts Markdown to plain text. A message that's all code
+// or all quote uses the /code or /quote prefix of HipChat.
+func markdownText(md string) string {
+	lines := strings.Split(strings.TrimSpace(md), "\n")
+
+	if code, ok := codeOnly(lines); ok {
+		return "/code " + code
+	}
+
+	var out []string
+	quotes, others := 0, 0
+	inCode := false
+
+	for _, line := range lines {
+		if mdFence.MatchString(line) {
+			inCode = !inCode
+			others++
+			continue
+		}
+		if inCode {
+			out = append(out, line)
+			others++
+			continue
+		}
+		if m := mdQuote.FindStringSubmatch(line); m != nil {
+			out = append(out, inline(m[1], false))
+			quotes++
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			others++
+		}
+
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			out = append(out, inline(m[1], false))
+		} else if m := mdBullet.FindStringSubmatch(line); m != nil {
+			out = append(out, "- "+inline(m[1], false))
+		} else if m := mdNumber.FindStringSubmatch(line); m != nil {
+			out = append(out, m[1]+". "+inline(m[2], false))
+		} else {
+			out = append(out, inline(line, false))
+		}
+	}
+
+	text := strings.Join(out, "\n")
+	if quotes > 0 && others == 0 {
+		return "/quote " + text
+	}
+
+	// HipChat takes a leading slash for a command
+	if strings.HasPrefix(text, "/") {
+		text = " " + text
+	}
+	return text
+}
+
+// codeOnly returns the content of lines when they're a single code block
+func codeOnly(lines []string) (string, bool) {
+	last := len(lines) - 1
+	if last < 1 || !mdFence.MatchString(lines[0]) ||
+		!mdFence.MatchString(lines[last]) {
+		return "", false
+	}
+
+	for _, line := range lines[1:last] {
+		if mdFence.MatchString(line) {
+			return "", false
+		}
+	}
+	return strings.Join(lines[1:last], "\n"), true
+}
+
+// markdownHTML converts Markdown to the HTML of HipChat notifications,
+// everything from the message is escaped
+func markdownHTML(md string) string {
+	var out bytes.Buffer
+	list := ""
+	inCode := false
+
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">")
+			list = tag
+		}
+	}
+	breakLine := func() {
+		if out.Len() > 0 {
+			out.WriteString("<br>")
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(md), "\n") {
+		if mdFence.MatchString(line) {
+			closeList()
+			if inCode {
+				out.WriteString("</pre>")
+			} else {
+				out.WriteString("<pre>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		if m := mdBullet.FindStringSubmatch(line); m != nil {
+			openList("ul")
+			out.WriteString("<li>" + inline(m[1], true) + "</li>")
+			continue
+		}
+		if m := mdNumber.FindStringSubmatch(line); m != nil {
+			openList("ol")
+			out.WriteString("<li>" + inline(m[2], true) + "</li>")
+			continue
+		}
+		closeList()
+
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			breakLine()
+			out.WriteString("<b>" + inline(m[1], true) + "</b>")
+		} else if m := mdQuote.FindStringSubmatch(line); m != nil {
+			breakLine()
+			out.WriteString("<i>" + inline(m[1], true) + "</i>")
+		} else {
+			breakLine()
+			out.WriteString(inline(line, true))
+		}
+	}
+
+	closeList()
+	if inCode {
+		out.WriteString("</pre>")
+	}
+	return out.String()
+}
+
+// inline converts the emphasis, code and links of a line
+func inline(md string, markup bool) string {
+	var out bytes.Buffer
+
+	plain := func(s string) string {
+		if markup {
+			return html.EscapeString(s)
+		}
+		return emoticon.ReplaceAllStringFunc(s, func(code string) string {
+			if e, ok := emoticons[code]; ok {
+				return e
+			}
+			return code
+		})
+	}
+
+	last := 0
+	for _, m := range mdInline.FindAllStringSubmatchIndex(md, -1) {
+		out.WriteString(plain(md[last:m[0]]))
+		last = m[1]
+
+		group := func(i int) string {
+			if m[2*i] < 0 {
+				return ""
+			}
+			return md[m[2*i]:m[2*i+1]]
+		}
+
+		switch {
+		case m[2] >= 0:
+			if markup {
+				out.WriteString("<code>" + html.EscapeString(group(1)) +
+					"</code>")
+			} else {
+				out.WriteString(group(1))
+			}
+		case m[8] >= 0:
+			out.WriteString(link(group(3), group(4), markup))
+		case m[10] >= 0 || m[12] >= 0:
+			out.WriteString(wrap("b", inline(group(5)+group(6), markup),
+				markup))
+		default:
+			out.WriteString(wrap("i", inline(group(7)+group(8), markup),
+				markup))
+		}
+	}
+	out.WriteString(plain(md[last:]))
+
+	return out.String()
+}
+
+func wrap(tag, s string, markup bool) string {
+	if !markup {
+		return s
+	}
+	return "<" + tag + ">" + s + "</" + tag + ">"
+}
+
+// link keeps the target of links with a label, only web and mail links are
+// kept in HTML
+func link(label, target string, markup bool) string {
+	if !markup {
+		if label == "" || label == target {
+			return target
+		}
+		return inline(label, false) + " (" + target + ")"
+	}
+
+	text := inline(label, true)
+	if label == "" {
+		text = html.EscapeString(target)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return text
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return `<a href="` + html.EscapeString(target) + `">` + text + "</a>"
+	}
+	return text
+}
@@ -0,0 +1,64 @@
+package hipchat
+
+import "testing"
+
+func TestMarkdownText(t *testing.T) {
+	tests := []struct {
+		md   string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"**bold** and _italic_", "bold and italic"},
+		{"run `make test` now", "run make test now"},
+		{"[docs](https://example.com/docs)", "docs (https://example.com/docs)"},
+		{"[https://a.io](https://a.io)", "https://a.io"},
+		{"# Deploy\n- one\n- two\n1. first", "Deploy\n- one\n- two\n1. first"},
+		{"nice :+1: :unknown:", "nice (thumbsup) :unknown:"},
+		{"```\nmake\nmake test\n```", "/code make\nmake test"},
+		{"> quoted\n> twice", "/quote quoted\ntwice"},
+		{"> quoted\nreply", "quoted\nreply"},
+		{"```\ncode\n```\ntext", "code\ntext"},
+		{"/join #ops", " /join #ops"},
+		{"a <b> & c", "a <b> & c"},
+	}
+
+	for _, test := range tests {
+		if got := markdownText(test.md); got != test.want {
+			t.Errorf("%q: text %q, want %q", test.md, got, test.want)
+		}
+	}
+}
+
+func TestMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		md   string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"a <b> & \"c\"", "a &lt;b&gt; &amp; &#34;c&#34;"},
+		{"**bold** and *italic*", "<b>bold</b> and <i>italic</i>"},
+		{"**<script>**", "<b>&lt;script&gt;</b>"},
+		{"`a<b`", "<code>a&lt;b</code>"},
+		{"line\nnext", "line<br>next"},
+		{"# Title\ntext", "<b>Title</b><br>text"},
+		{"> quoted", "<i>quoted</i>"},
+		{"- one\n- two\n1. first",
+			"<ul><li>one</li><li>two</li></ul><ol><li>first</li></ol>"},
+		{"```\nif a < b {\n```", "<pre>if a &lt; b {\n</pre>"},
+		{"```\nunclosed", "<pre>unclosed\n</pre>"},
+		{"[docs](https://example.com/?a=1&b=2)",
+			`<a href="https://example.com/?a=1&amp;b=2">docs</a>`},
+		{"[](mailto:ops@example.com)",
+			`<a href="mailto:ops@example.com">mailto:ops@example.com</a>`},
+		{"[click](javascript:alert%281%29)", "click"},
+		{"[x](data:text/html,hi)", "x"},
+		{"[x](ftp://example.com/f)", "x"},
+		{"[**b**](vbscript:x)", "<b>b</b>"},
+	}
+
+	for _, test := range tests {
+		if got := markdownHTML(test.md); got != test.want {
+			t.Errorf("%q: HTML %q, want %q", test.md, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package hipchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var stateNames = map[int]string{
+	stateDisconnected: "disconnected",
+	stateConnecting:   "connecting",
+	stateConnected:    "connected",
+}
+
+// connStatus is what the health endpoints report about a hipchat connection,
+// it's updated from the listen goroutine and read from the HTTP handlers
+type connStatus struct {
+	sync.Mutex
+	state      int
+	jid        string
+	joined     int
+	lastStanza time.Time
+}
+
+type priscillaStatus struct {
+	sync.Mutex
+	engaged   bool
+	lastQuery time.Time
+}
+
+type accountHealth struct {
+	State     string   `json:"state"`
+	Jid       string   `json:"jid,omitempty"`
+	Joined    int      `json:"joined_rooms"`
+	StanzaAge *float64 `json:"last_stanza_age_seconds,omitempty"`
+}
+
+type priscillaHealth struct {
+	Engaged  bool     `json:"engaged"`
+	QueryAge *float64 `json:"last_query_age_seconds,omitempty"`
+}
+
+type healthReport struct {
+	Ready     bool                     `json:"ready"`
+	Priscilla priscillaHealth          `json:"priscilla"`
+	Accounts  map[string]accountHealth `json:"accounts"`
+}
+
+type healthHandler struct {
+	clients    map[string]*client
+	prisStatus *priscillaStatus
+}
+
+func (s *connStatus) setState(state int) {
+	s.Lock()
+	s.state = state
+	if state != stateConnected {
+		s.joined = 0
+	}
+	s.Unlock()
+}
+
+func (s *connStatus) setJid(jid string) {
+	s.Lock()
+	s.jid = jid
+	s.Unlock()
+}
+
+func (s *connStatus) setJoined(joined int) {
+	s.Lock()
+	s.joined = joined
+	s.Unlock()
+}
+
+func (s *connStatus) received() {
+	s.Lock()
+	s.lastStanza = time.Now()
+	s.Unlock()
+}
+
+func (s *priscillaStatus) setEngaged(engaged bool) {
+	s.Lock()
+	s.engaged = engaged
+	s.Unlock()
+}
+
+func (s *priscillaStatus) isEngaged() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.engaged
+}
+
+func (s *priscillaStatus) received() {
+	s.Lock()
+	s.lastQuery = time.Now()
+	s.Unlock()
+}
+
+func age(t time.Time) *float64 {
+	if t.IsZero() {
+		return nil
+	}
+	seconds := time.Since(t).Seconds()
+	return &seconds
+}
+
+func (h *healthHandler) report() *healthReport {
+	report := &healthReport{
+		Ready:    true,
+		Accounts: make(map[string]accountHealth, len(h.clients)),
+	}
+
+	h.prisStatus.Lock()
+	report.Priscilla = priscillaHealth{
+		Engaged:  h.prisStatus.engaged,
+		QueryAge: age(h.prisStatus.lastQuery),
+	}
+	h.prisStatus.Unlock()
+
+	if !report.Priscilla.Engaged {
+		report.Ready = false
+	}
+
+	for name, c := range h.clients {
+		c.status.Lock()
+		account := accountHealth{
+			State:     stateNames[c.status.state],
+			Jid:       c.status.jid,
+			Joined:    c.status.joined,
+			StanzaAge: age(c.status.lastStanza),
+		}
+		connected := c.status.state == stateConnected
+		c.status.Unlock()
+
+		if !connected {
+			report.Ready = false
+		}
+
+		if name == "" {
+			name = "default"
+		}
+		report.Accounts[name] = account
+	}
+
+	return report
+}
+
+func writeReport(w http.ResponseWriter, status int, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// live reports whether the adapter is still up, it only fails once priscilla
+// disengaged and the adapter is on its way out
+func (h *healthHandler) live(w http.ResponseWriter, req *http.Request) {
+	report := h.report()
+	status := http.StatusOK
+	if !report.Priscilla.Engaged {
+		status = http.StatusServiceUnavailable
+	}
+	writeReport(w, status, report)
+}
+
+// ready reports whether every account is connected and priscilla is engaged,
+// it's false while reconnecting
+func (h *healthHandler) ready(w http.ResponseWriter, req *http.Request) {
+	report := h.report()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeReport(w, status, report)
+}
+
+func (b *Bridge) health() *healthHandler {
+	return &healthHandler{clients: b.clients, prisStatus: b.prisStatus}
+}
+
+// LiveHandler serves the liveness check of the bridge as JSON
+func (b *Bridge) LiveHandler() http.Handler {
+	return http.HandlerFunc(b.health().live)
+}
+
+// ReadyHandler serves the readiness check of the bridge as JSON
+func (b *Bridge) ReadyHandler() http.Handler {
+	return http.HandlerFunc(b.health().ready)
+}
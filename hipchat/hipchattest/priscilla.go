@@ -0,0 +1,176 @@
+// Package hipchattest helps testing code built on the hipchat package without
+// a priscilla server.
+//
+// It's a supported runtime package as well, the console mode of the adapter
+// runs on its Server. It doesn't depend on the testing package and doesn't
+// add flags to the binaries importing it.
+package hipchattest
+
+import (
+	"context"
+	"github.com/priscillachat/prisclient"
+	"strconv"
+	"sync"
+)
+
+// Priscilla is an in-memory hipchat.Priscilla, and a hipchat.Engager that's
+// engaged as soon as it runs. It records every query the bridge sends and
+// injects queries of its own.
+type Priscilla struct {
+	engaged     chan struct{}
+	engagedOnce sync.Once
+
+	mu      sync.Mutex
+	queries []*prisclient.Query
+	// closed and replaced whenever a query is recorded
+	changed chan struct{}
+	inject  chan *prisclient.Query
+	lastId  int
+}
+
+// NewPriscilla returns a Priscilla with nothing recorded, set it as the
+// Priscilla of the bridge
+func NewPriscilla() *Priscilla {
+	return &Priscilla{
+		engaged: make(chan struct{}),
+		changed: make(chan struct{}),
+		inject:  make(chan *prisclient.Query),
+	}
+}
+
+// Run passes the injected queries to the bridge and records what it sends
+// until ctx is done
+func (p *Priscilla) Run(ctx context.Context,
+	toPris <-chan *prisclient.Query, fromPris chan<- *prisclient.Query) {
+
+	p.engagedOnce.Do(func() {
+		close(p.engaged)
+	})
+
+	for {
+		select {
+		case query := <-toPris:
+			p.record(query)
+		case query := <-p.inject:
+			select {
+			case fromPris <- query:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			// record what's left
+			for {
+				select {
+				case query := <-toPris:
+					p.record(query)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Engaged is closed once Run is called
+func (p *Priscilla) Engaged() <-chan struct{} {
+	return p.engaged
+}
+
+func (p *Priscilla) record(query *prisclient.Query) {
+	p.mu.Lock()
+	p.queries = append(p.queries, query)
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.mu.Unlock()
+}
+
+// Send injects query, it returns once the bridge has it or ctx is done
+func (p *Priscilla) Send(ctx context.Context, query *prisclient.Query) error {
+	select {
+	case p.inject <- query:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Command injects a command, the id it was sent with is returned to find the
+// response with Response
+func (p *Priscilla) Command(ctx context.Context, action, typ,
+	data string) (string, error) {
+
+	p.mu.Lock()
+	p.lastId++
+	id := "test-" + strconv.Itoa(p.lastId)
+	p.mu.Unlock()
+
+	return id, p.Send(ctx, &prisclient.Query{
+		Type:   "command",
+		Source: "server",
+		Command: &prisclient.CommandBlock{
+			Id:     id,
+			Action: action,
+			Type:   typ,
+			Data:   data,
+		},
+	})
+}
+
+// Message injects a message to be sent to room
+func (p *Priscilla) Message(ctx context.Context, room, message string) error {
+	return p.Send(ctx, &prisclient.Query{
+		Type:   "message",
+		Source: "server",
+		Message: &prisclient.MessageBlock{
+			Room:    room,
+			Message: message,
+		},
+	})
+}
+
+// Queries returns the queries recorded so far
+func (p *Priscilla) Queries() []*prisclient.Query {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queries := make([]*prisclient.Query, len(p.queries))
+	copy(queries, p.queries)
+	return queries
+}
+
+// Wait waits for a recorded query match accepts, including the ones recorded
+// before the call
+func (p *Priscilla) Wait(ctx context.Context,
+	match func(*prisclient.Query) bool) (*prisclient.Query, error) {
+
+	seen := 0
+
+	for {
+		p.mu.Lock()
+		queries, changed := p.queries[seen:], p.changed
+		seen = len(p.queries)
+		p.mu.Unlock()
+
+		for _, query := range queries {
+			if match(query) {
+				return query, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Response waits for the response to the command sent with id
+func (p *Priscilla) Response(ctx context.Context,
+	id string) (*prisclient.Query, error) {
+
+	return p.Wait(ctx, func(query *prisclient.Query) bool {
+		return query.Type == "command" && query.Command != nil &&
+			query.Command.Action == "info" && query.Command.Id == id
+	})
+}
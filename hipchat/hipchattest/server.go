@@ -0,0 +1,316 @@
+package hipchattest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	serverFeatures = `<stream:stream xmlns='jabber:client'
+	xmlns:stream='http://etherx.jabber.org/streams'
+	from='chat.hipchat.com' id='hipchattest' version='1.0'>
+	<stream:features><auth xmlns='http://hipchat.com'/></stream:features>`
+
+	// no token, the REST API isn't simulated
+	serverSuccess = `<success xmlns='http://hipchat.com' jid='%s'
+	chat_host='chat.hipchat.com' muc_host='conf.hipchat.com'/>`
+)
+
+// Server is a HipChat XMPP server in memory, for one bot account and the
+// users and rooms it's given. Set Dial as the Dial of the account.
+type Server struct {
+	// Bot is who logs in
+	Bot   xmpp.User
+	Users []xmpp.User
+	Rooms []xmpp.Room
+	// OnMessage is called with every groupchat message the bot sends, room
+	// is the room name
+	OnMessage func(room, body string)
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	conn    net.Conn
+	joined  map[string]bool
+	lastId  int
+}
+
+// Dial connects a new session, the previous one is dropped
+func (s *Server) Dial() (*xmpp.Conn, error) {
+	client, server := net.Pipe()
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = server
+	s.joined = make(map[string]bool)
+	s.mu.Unlock()
+
+	go s.serve(server)
+
+	return xmpp.NewConn(client), nil
+}
+
+// Say sends body to room as user, both by name
+func (s *Server) Say(user, room, body string) error {
+	return s.say(user, room, body, nil)
+}
+
+// Share shares file in room as user, the body is the file name like HipChat
+// does
+func (s *Server) Share(user, room string, file xmpp.File) error {
+	return s.say(user, room, file.Name, &file)
+}
+
+// Notify posts a notification in room like an integration named sender does
+// through the REST API, format is "html" or "text"
+func (s *Server) Notify(sender, room, format, body string) error {
+	to, ok := s.room(room)
+	if !ok {
+		return fmt.Errorf("Unknown room: %s", room)
+	}
+
+	conn, err := s.joinedConn(to, room)
+	if err != nil {
+		return err
+	}
+
+	return s.send(conn, &xmpp.Message{
+		Type:   "groupchat",
+		From:   to.Id,
+		To:     s.Bot.Jid,
+		Id:     s.nextId(),
+		Body:   body,
+		Format: format,
+		Sender: sender,
+	})
+}
+
+func (s *Server) say(user, room, body string, file *xmpp.File) error {
+	from, ok := s.user(user)
+	if !ok {
+		return fmt.Errorf("Unknown user: %s", user)
+	}
+
+	to, ok := s.room(room)
+	if !ok {
+		return fmt.Errorf("Unknown room: %s", room)
+	}
+
+	conn, err := s.joinedConn(to, room)
+	if err != nil {
+		return err
+	}
+
+	return s.send(conn, &xmpp.Message{
+		Type:    "groupchat",
+		From:    to.Id + "/" + from.Name,
+		FromJid: from.Jid,
+		To:      s.Bot.Jid,
+		Id:      s.nextId(),
+		Body:    body,
+		File:    file,
+	})
+}
+
+func (s *Server) joinedConn(to xmpp.Room, room string) (net.Conn, error) {
+	s.mu.Lock()
+	conn, joined := s.conn, s.joined[to.Id]
+	s.mu.Unlock()
+
+	if conn == nil {
+		return nil, xmpp.ErrNotConnected
+	}
+	if !joined {
+		return nil, fmt.Errorf("Room not joined: %s", room)
+	}
+	return conn, nil
+}
+
+func (s *Server) user(name string) (xmpp.User, bool) {
+	for _, user := range s.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return xmpp.User{}, false
+}
+
+func (s *Server) room(name string) (xmpp.Room, bool) {
+	for _, room := range s.Rooms {
+		if room.Name == name {
+			return room, true
+		}
+	}
+	return xmpp.Room{}, false
+}
+
+func (s *Server) nextId() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastId++
+	return "hipchattest-" + strconv.Itoa(s.lastId)
+}
+
+func (s *Server) send(conn net.Conn, stanza interface{}) error {
+	out, err := xml.Marshal(stanza)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = conn.Write(out)
+	return err
+}
+
+func (s *Server) write(conn net.Conn, raw string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := conn.Write([]byte(raw))
+	return err
+}
+
+// serve answers one session until the bot leaves or the connection is
+// dropped
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := xml.NewDecoder(conn)
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch element.Name.Local {
+		case "stream":
+			err = s.write(conn, serverFeatures)
+		case "auth":
+			if err = decoder.Skip(); err == nil {
+				err = s.write(conn, fmt.Sprintf(serverSuccess, s.Bot.Jid))
+			}
+		case "iq":
+			var iq xmpp.IncomingIq
+			if err = decoder.DecodeElement(&iq, &element); err == nil {
+				err = s.answer(conn, &iq)
+			}
+		case "presence":
+			var presence struct {
+				Type string `xml:"type,attr"`
+				To   string `xml:"to,attr"`
+			}
+			if err = decoder.DecodeElement(&presence, &element); err == nil {
+				err = s.presence(conn, presence.Type, presence.To)
+			}
+		case "message":
+			var message xmpp.Message
+			err = decoder.DecodeElement(&message, &element)
+			if err == nil && message.Type == "groupchat" {
+				s.message(&message)
+			}
+		default:
+			err = decoder.Skip()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) answer(conn net.Conn, iq *xmpp.IncomingIq) error {
+	if iq.Type != "get" && iq.Type != "set" {
+		return nil
+	}
+
+	reply := &xmpp.Iq{Type: "result", Id: iq.Id, From: iq.To, To: iq.From}
+
+	switch iq.Query.XMLName.Space {
+	case xmpp.NsVCard:
+		user := s.Bot
+		for _, u := range s.Users {
+			if u.Jid == iq.To {
+				user = u
+			}
+		}
+		reply.Query = card(&user)
+	case xmpp.NsDiscoItems:
+		reply.Query = &struct {
+			XMLName xml.Name
+			Rooms   []xmpp.Room `xml:"item"`
+		}{
+			XMLName: xml.Name{Space: xmpp.NsDiscoItems, Local: "query"},
+			Rooms:   s.Rooms,
+		}
+	case xmpp.NsPing:
+	default:
+		reply.Type = "error"
+		reply.Query = xmpp.NewStanzaError("cancel", "service-unavailable")
+	}
+
+	return s.send(conn, reply)
+}
+
+func card(user *xmpp.User) *xmpp.Card {
+	return &xmpp.Card{
+		Name:     user.Name,
+		Nickname: user.Mention,
+		Email:    user.Email,
+	}
+}
+
+// presence tracks the rooms joined, and pushes the vCards of the users once
+// the bot is available
+func (s *Server) presence(conn net.Conn, typ, to string) error {
+	if to != "" {
+		room := strings.Split(to, "/")[0]
+		s.mu.Lock()
+		s.joined[room] = typ != "unavailable"
+		s.mu.Unlock()
+		return nil
+	}
+
+	if typ == "unavailable" {
+		return nil
+	}
+
+	for i := range s.Users {
+		err := s.send(conn, &xmpp.Iq{
+			Type:  "result",
+			Id:    s.nextId(),
+			From:  s.Users[i].Jid,
+			To:    s.Bot.Jid,
+			Query: card(&s.Users[i]),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) message(message *xmpp.Message) {
+	if s.OnMessage == nil {
+		return
+	}
+
+	id := strings.Split(message.To, "/")[0]
+	for _, room := range s.Rooms {
+		if room.Id == id {
+			s.OnMessage(room.Name, message.Body)
+			return
+		}
+	}
+}
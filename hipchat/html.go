@@ -0,0 +1,80 @@
+package hipchat
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlCode = regexp.MustCompile(
+		`(?is)<script\b.*?</script\s*>|<style\b.*?</style\s*>`)
+	htmlTag = regexp.MustCompile(`(?s)<(/?)([a-zA-Z0-9]+)([^>]*)>|<!--.*?-->`)
+	htmlRef = regexp.MustCompile(`(?i)\bhref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	// runs of blanks, the blanks around line breaks and empty lines
+	blanks     = regexp.MustCompile(`[ \t\r\n]+`)
+	lineBlanks = regexp.MustCompile(` *\n *`)
+	blankLines = regexp.MustCompile(`\n{2,}`)
+)
+
+// elements ending a line, the others are inline
+var htmlBlocks = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "tr": true,
+	"table": true, "ul": true, "ol": true, "pre": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// htmlText turns the HTML of a notification into plain text: tags are
+// dropped, block elements break lines, list items get a dash and links keep
+// their target when it differs from their text
+func htmlText(markup string) string {
+	var text bytes.Buffer
+	var href []string
+	var linkStart int
+
+	markup = htmlCode.ReplaceAllString(markup, "")
+
+	last := 0
+	for _, loc := range htmlTag.FindAllStringSubmatchIndex(markup, -1) {
+		text.WriteString(blanks.ReplaceAllString(markup[last:loc[0]], " "))
+		last = loc[1]
+
+		// a comment
+		if loc[2] < 0 {
+			continue
+		}
+
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(markup[loc[4]:loc[5]])
+
+		switch {
+		case name == "a" && !closing:
+			target := ""
+			attrs := markup[loc[6]:loc[7]]
+			if m := htmlRef.FindStringSubmatch(attrs); m != nil {
+				target = html.UnescapeString(strings.Trim(m[1], `"'`))
+			}
+			href = append(href, target)
+			linkStart = text.Len()
+		case name == "a" && len(href) > 0:
+			target := href[len(href)-1]
+			href = href[:len(href)-1]
+			label := html.UnescapeString(text.String()[linkStart:])
+			if target != "" && strings.TrimSpace(label) != target {
+				text.WriteString(" (" + target + ")")
+			}
+		case name == "li" && !closing:
+			text.WriteString("\n- ")
+		case htmlBlocks[name]:
+			text.WriteString("\n")
+		}
+	}
+	text.WriteString(blanks.ReplaceAllString(markup[last:], " "))
+
+	plain := html.UnescapeString(text.String())
+	plain = strings.Replace(plain, "\u00a0", " ", -1)
+	plain = lineBlanks.ReplaceAllString(plain, "\n")
+	plain = blankLines.ReplaceAllString(plain, "\n")
+	return strings.TrimSpace(plain)
+}
@@ -0,0 +1,40 @@
+package hipchat
+
+import "testing"
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		markup string
+		want   string
+	}{
+		{"plain", "plain"},
+		{"a &amp; b &lt;c&gt; &#34;d&#34; &eacute;", `a & b <c> "d" é`},
+		{"&amp;lt;", "&lt;"},
+		{"non&nbsp;breaking", "non breaking"},
+		{"one<br>two<br/>three<BR />four", "one\ntwo\nthree\nfour"},
+		{"<p>first</p><p>second</p>", "first\nsecond"},
+		{"<div>a</div>\n\n<div>  b  </div>", "a\nb"},
+		{"<h1>Title</h1>text", "Title\ntext"},
+		{"<ul><li>one</li><li>two</li></ul>", "- one\n- two"},
+		{"<table><tr><td>a</td><td>b</td></tr><tr><td>c</td></tr></table>",
+			"ab\nc"},
+		{"<b>Build <i>#1</i></b> failed", "Build #1 failed"},
+		{"<b><i><u>deep</u></i></b>", "deep"},
+		{"<ul><li>outer<ul><li>inner</li></ul></li></ul>",
+			"- outer\n- inner"},
+		{`<a href="https://ci.example.com/1">Build #1</a>`,
+			"Build #1 (https://ci.example.com/1)"},
+		{`<a href='https://a.io'>https://a.io</a>`, "https://a.io"},
+		{`<a href="https://a.io/?x=1&amp;y=2"><b>run</b></a> done`,
+			"run (https://a.io/?x=1&y=2) done"},
+		{"<a name=top>anchor</a>", "anchor"},
+		{"a<!-- hidden <b>x</b> -->b", "ab"},
+		{"<script>alert(1)</script>ok<style>b{}</style>", "ok"},
+	}
+
+	for _, test := range tests {
+		if got := htmlText(test.markup); got != test.want {
+			t.Errorf("%q: text %q, want %q", test.markup, got, test.want)
+		}
+	}
+}
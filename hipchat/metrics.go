@@ -0,0 +1,222 @@
+package hipchat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connection states, as reported by hipchat_connection_state
+const (
+	stateDisconnected = iota
+	stateConnecting
+	stateConnected
+)
+
+type metricKind string
+
+const (
+	counterMetric metricKind = "counter"
+	gaugeMetric   metricKind = "gauge"
+	summaryMetric metricKind = "summary"
+)
+
+type sample struct {
+	labels []string
+	value  float64
+	count  float64
+}
+
+// metric is a family of samples told apart by label values, kept in the
+// Prometheus text format's terms
+type metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	samples map[string]*sample
+	collect func() map[string]float64
+}
+
+type registry struct {
+	sync.Mutex
+	metrics []*metric
+}
+
+var metrics = &registry{}
+
+var (
+	messagesReceived = metrics.newMetric("hipchat_messages_received_total",
+		"Messages received from hipchat rooms", counterMetric,
+		"account", "room")
+	messagesSent = metrics.newMetric("hipchat_messages_sent_total",
+		"Messages sent to hipchat rooms", counterMetric, "account", "room")
+	messagesFailed = metrics.newMetric("hipchat_messages_failed_total",
+		"Messages to hipchat rooms given up on", counterMetric, "account",
+		"room")
+	mentions = metrics.newMetric("hipchat_mentions_total",
+		"Messages mentioning the bot", counterMetric, "account", "room")
+	reconnects = metrics.newMetric("hipchat_reconnect_attempts_total",
+		"Attempts to (re)establish the hipchat connection", counterMetric,
+		"account")
+	reconnectBackoff = metrics.newMetric("hipchat_reconnect_backoff_seconds",
+		"Time spent waiting between connection attempts", summaryMetric,
+		"account")
+	userLookups = metrics.newMetric("hipchat_user_lookups_total",
+		"User lookups through the hipchat REST API", counterMetric, "account")
+	userLookupFailures = metrics.newMetric(
+		"hipchat_user_lookup_failures_total",
+		"Failed user lookups through the hipchat REST API", counterMetric,
+		"account")
+	filesShared = metrics.newMetric("hipchat_files_shared_total",
+		"Files shared through the hipchat REST API", counterMetric,
+		"account")
+	filesFailed = metrics.newMetric("hipchat_file_share_failures_total",
+		"Files that failed to upload", counterMetric, "account")
+	keepAliveRTT = metrics.newMetric("hipchat_keepalive_rtt_seconds",
+		"Round trip time of keepalive pings", summaryMetric, "account")
+	connectionState = metrics.newMetric("hipchat_connection_state",
+		"Connection state, 0 disconnected, 1 connecting, 2 connected",
+		gaugeMetric, "account")
+	queueDepth = metrics.newMetric("hipchat_queue_depth",
+		"Messages waiting in the adapter's internal queues", gaugeMetric,
+		"queue")
+)
+
+func (r *registry) newMetric(name, help string, kind metricKind,
+	labels ...string) *metric {
+
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+
+	r.Lock()
+	r.metrics = append(r.metrics, m)
+	r.Unlock()
+
+	return m
+}
+
+func (m *metric) sample(labels []string) *sample {
+	key := strings.Join(labels, "\x00")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labels: labels}
+		m.samples[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+func (m *metric) add(value float64, labels ...string) {
+	m.Lock()
+	m.sample(labels).value += value
+	m.Unlock()
+}
+
+func (m *metric) set(value float64, labels ...string) {
+	m.Lock()
+	m.sample(labels).value = value
+	m.Unlock()
+}
+
+// observe records one observation of a summary
+func (m *metric) observe(value float64, labels ...string) {
+	m.Lock()
+	s := m.sample(labels)
+	s.value += value
+	s.count++
+	m.Unlock()
+}
+
+func (m *metric) observeDuration(d time.Duration, labels ...string) {
+	m.observe(d.Seconds(), labels...)
+}
+
+// collectWith makes a gauge read its values at scrape time, collect returns
+// them keyed by the (single) label value
+func (m *metric) collectWith(collect func() map[string]float64) {
+	m.Lock()
+	m.collect = collect
+	m.Unlock()
+}
+
+func (m *metric) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.collect != nil {
+		for label, value := range m.collect() {
+			m.sample([]string{label}).value = value
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.samples))
+	for key := range m.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.samples[key]
+		labels := m.formatLabels(s.labels)
+
+		if m.kind == summaryMetric {
+			fmt.Fprintf(w, "%s_sum%s %g\n", m.name, labels, s.value)
+			fmt.Fprintf(w, "%s_count%s %g\n", m.name, labels, s.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, labels, s.value)
+		}
+	}
+}
+
+func (m *metric) formatLabels(values []string) string {
+	if len(m.labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(m.labels))
+	for i, name := range m.labels {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var out bytes.Buffer
+
+	r.Lock()
+	for _, m := range r.metrics {
+		m.write(&out)
+	}
+	r.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+// MetricsHandler serves the metrics of every bridge in the Prometheus text
+// format
+func MetricsHandler() http.Handler {
+	return metrics
+}
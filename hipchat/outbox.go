@@ -0,0 +1,154 @@
+package hipchat
+
+import (
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"time"
+)
+
+// messages priscilla sends while an account is disconnected or held back by
+// its rate limit wait in its outbox, up to outboxSize of them for at most
+// outboxTTL
+const (
+	outboxSize = 100
+	outboxTTL  = 5 * time.Minute
+)
+
+type queuedMessage struct {
+	message *prisclient.MessageBlock
+	// the room as priscilla knows it, for failure reports
+	room   string
+	queued time.Time
+}
+
+// failureReporter tells priscilla a message couldn't be delivered
+type failureReporter func(room, message, reason string)
+
+// reportTo reports to priscilla, giving up once expired is closed
+func reportTo(toPris chan<- *prisclient.Query,
+	expired <-chan struct{}) failureReporter {
+
+	return func(room, message, reason string) {
+		failure := &prisclient.Query{
+			Type: "command",
+			To:   "server",
+			Command: &prisclient.CommandBlock{
+				Id:     prisclient.RandomId(),
+				Action: "message_failed",
+				Type:   "message",
+				Error:  reason,
+				Map: map[string]string{
+					"room":    room,
+					"message": message,
+				},
+			},
+		}
+
+		select {
+		case toPris <- failure:
+		case <-expired:
+			logger.Warn.Println("Timed out reporting the failed message to",
+				room)
+		}
+	}
+}
+
+func (c *client) failed(q *queuedMessage, reason string,
+	report failureReporter) {
+
+	logger.Warn.Println("Message to", q.room, "failed:", reason)
+	messagesFailed.inc(c.account, q.message.Room)
+	report(q.room, q.message.Message, reason)
+}
+
+// send delivers a message, or queues it while the connection is down or the
+// rate limit holds it back. Queued messages go first, so the order is kept.
+// Other failures are reported right away.
+func (c *client) send(message *prisclient.MessageBlock, room string,
+	report failureReporter) {
+
+	q := &queuedMessage{message: message, room: room, queued: time.Now()}
+
+	if len(c.outbox) == 0 && c.holdBack() <= 0 {
+		err := c.groupMessage(q, report)
+		if err == nil {
+			return
+		}
+		if !disconnected(err) {
+			c.failed(q, err.Error(), report)
+			return
+		}
+		logger.Warn.Println("Queueing message to", room+":", err)
+	}
+
+	if len(c.outbox) >= outboxSize {
+		c.failed(q, "Outbox full", report)
+		return
+	}
+	c.outbox = append(c.outbox, q)
+	c.pace(report)
+}
+
+// flush sends the queued messages the rate limit allows once the connection
+// is back, dropping the expired ones
+func (c *client) flush(report failureReporter) {
+	c.expire(report)
+
+	for len(c.outbox) > 0 {
+		if c.holdBack() > 0 {
+			c.pace(report)
+			return
+		}
+		err := c.groupMessage(c.outbox[0], report)
+		if err != nil && disconnected(err) {
+			logger.Warn.Println("Failed to flush outbox of account",
+				c.account+":", err)
+			return
+		}
+		if err != nil {
+			c.failed(c.outbox[0], err.Error(), report)
+		}
+		c.outbox = c.outbox[1:]
+	}
+}
+
+// disconnected tells whether a message failed for the lack of a connection,
+// it's queued until the account reconnects then
+func disconnected(err error) bool {
+	return err == xmpp.ErrNotConnected || err == xmpp.ErrConnClosed
+}
+
+// pace flushes the outbox on the bridge loop once the rate limit allows,
+// the loop never waits for it
+func (c *client) pace(report failureReporter) {
+	wait := c.holdBack()
+	if wait <= 0 || c.pacer != nil {
+		return
+	}
+
+	c.pacer = time.AfterFunc(wait, func() {
+		c.bridge.Do(func() {
+			c.pacer = nil
+			c.flush(report)
+		})
+	})
+}
+
+func (c *client) expire(report failureReporter) {
+	for len(c.outbox) > 0 && time.Since(c.outbox[0].queued) > outboxTTL {
+		c.failed(c.outbox[0], "Expired while disconnected", report)
+		c.outbox = c.outbox[1:]
+	}
+}
+
+// discard reports everything still queued as failed
+func (c *client) discard(reason string, report failureReporter) {
+	if c.pacer != nil {
+		c.pacer.Stop()
+		c.pacer = nil
+	}
+	for _, q := range c.outbox {
+		c.failed(q, reason, report)
+	}
+	c.outbox = nil
+}
@@ -0,0 +1,61 @@
+package hipchat
+
+import (
+	"bytes"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/prisclient"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ANSI escape sequences, colors mostly, in command output
+var ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|[@-Z\\-_])`)
+
+// sanitize makes body valid XML 1.0 text: invalid UTF-8 is replaced and
+// characters XML doesn't allow are dropped, after ANSI escape sequences when
+// stripANSI. It tells whether anything was changed.
+func sanitize(body string, stripANSI bool) (string, bool) {
+	clean := body
+	if stripANSI {
+		clean = ansiEscape.ReplaceAllString(clean, "")
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(clean); {
+		r, size := utf8.DecodeRuneInString(clean[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			out.WriteRune(utf8.RuneError)
+		case validXMLChar(r):
+			out.WriteString(clean[i : i+size])
+		}
+		i += size
+	}
+
+	clean = out.String()
+	return clean, clean != body
+}
+
+// validXMLChar tells whether XML 1.0 allows r
+func validXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xd7ff ||
+		r >= 0xe000 && r <= 0xfffd ||
+		r >= 0x10000 && r <= utf8.MaxRune
+}
+
+// sanitize returns the body of message cleaned up to be sent, logging when
+// it was altered
+func (c *client) sanitize(message *prisclient.MessageBlock) string {
+	clean, altered := sanitize(message.Message, c.bridge.opts.StripANSI)
+	if altered {
+		logging.Event(logger.Warn, "Message body sanitized", logging.Fields{
+			"account": c.account,
+			"room":    message.Room,
+			"before":  strconv.Itoa(len(message.Message)),
+			"after":   strconv.Itoa(len(clean)),
+		})
+	}
+	return clean
+}
@@ -0,0 +1,34 @@
+package hipchat
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		stripANSI bool
+		want      string
+	}{
+		{"clean", "all good\n\tindented", true, "all good\n\tindented"},
+		{"unicode", "héllo 世界 🎉", true, "héllo 世界 🎉"},
+		{"NUL", "a\x00b", false, "ab"},
+		{"control", "bell\x07 and form\x0cfeed", false, "bell and formfeed"},
+		{"noncharacter", "a\ufffeb", false, "ab"},
+		{"invalid UTF-8", "a\xffb\xc3", false, "a\ufffdb\ufffd"},
+		{"ANSI colors", "\x1b[31mred\x1b[0m", true, "red"},
+		{"ANSI cursor", "\x1b[2K\x1b[1Gdone", true, "done"},
+		{"ANSI kept", "\x1b[31mred\x1b[0m", false, "[31mred[0m"},
+		{"ANSI and NUL", "\x1b[1mbold\x1b[0m\x00", true, "bold"},
+	}
+
+	for _, test := range tests {
+		got, altered := sanitize(test.body, test.stripANSI)
+		if got != test.want {
+			t.Errorf("%s: sanitized %q to %q, want %q", test.name, test.body,
+				got, test.want)
+		}
+		if altered != (test.body != test.want) {
+			t.Errorf("%s: altered is %v", test.name, altered)
+		}
+	}
+}
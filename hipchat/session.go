@@ -0,0 +1,91 @@
+package hipchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"strings"
+	"time"
+)
+
+// Session is a single connection of an account for one-shot operations, it
+// joins no room on its own and nothing is passed to priscilla
+type Session struct {
+	c *client
+}
+
+// Connect logs account in and discovers its rooms, the session lasts until
+// Close or until ctx is done
+func Connect(ctx context.Context, account Account) (*Session, error) {
+	account.Rooms = map[string]bool{}
+
+	c := newClient(&Bridge{opts: Options{Name: "priscilla-hipchat"}},
+		&account)
+	c.start(ctx)
+
+	if err := c.establishConnection(); err != nil {
+		c.close(time.Time{})
+		return nil, err
+	}
+
+	// nobody listens, what's not a reply is dropped
+	go func() {
+		for {
+			select {
+			case event := <-c.events:
+				if event.Err != nil {
+					return
+				}
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return &Session{c: c}, nil
+}
+
+// Rooms returns the rooms discovered, by name
+func (s *Session) Rooms() []xmpp.Room {
+	return s.c.roomList()
+}
+
+// Send joins room, sends message to it and leaves again
+func (s *Session) Send(room, message string) error {
+	id, ok := s.c.roomId(room)
+	if !ok {
+		return fmt.Errorf("Room not found: %s", room)
+	}
+
+	s.c.join([]string{id})
+	if !s.c.isJoined(id) {
+		return fmt.Errorf("Failed to join room: %s", room)
+	}
+	defer s.c.leave([]string{id})
+
+	return s.c.post(&prisclient.MessageBlock{Room: room, Message: message})
+}
+
+// Whois looks a user up, by jid through its vCard, otherwise by id, email or
+// @mention through the REST API
+func (s *Session) Whois(ctx context.Context,
+	user string) (*xmpp.User, error) {
+
+	login := s.c.login()
+	if strings.HasSuffix(user, "@"+login.chatHost) ||
+		strings.HasSuffix(user, "@"+hipchatHost) {
+		return s.c.conn().VCard(ctx, login.jid, user)
+	}
+
+	if login.api == nil {
+		return nil, errors.New("No REST API client, look the user up by jid")
+	}
+	return s.c.lookupUser(user)
+}
+
+// Close signs off
+func (s *Session) Close() {
+	s.c.close(time.Time{})
+}
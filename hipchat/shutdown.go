@@ -0,0 +1,210 @@
+package hipchat
+
+import (
+	"errors"
+	"github.com/priscillachat/prisclient"
+	"time"
+)
+
+// exit status of the adapter
+const (
+	exitOK         = 0
+	exitNotEngaged = 2
+	exitDisengaged = 3
+	exitUnclean    = 4
+)
+
+var (
+	// ErrDisengaged is why a bridge stops when priscilla disengages
+	ErrDisengaged = errors.New("Priscilla disengaged")
+	// ErrNotEngaged is why a bridge stops when priscilla gives up before the
+	// adapter was ever engaged
+	ErrNotEngaged = errors.New("Priscilla never engaged")
+	// ErrFinished is why a bridge stops when no account has anything left
+	// to connect to, see ErrNoMoreConnections
+	ErrFinished = errors.New("HipChat side finished")
+	// ErrNotRunning is returned when asking a bridge that isn't running
+	ErrNotRunning = errors.New("Bridge is not running")
+)
+
+// stopError tells why a bridge stopped: ErrDisengaged, ErrNotEngaged,
+// ErrFinished or the error of the context it ran in
+type stopError struct {
+	reason  error
+	unclean bool
+}
+
+func (e *stopError) Error() string {
+	if e.unclean {
+		return e.reason.Error() + ", shutdown did not finish in time"
+	}
+	return e.reason.Error()
+}
+
+// ExitCode is the exit status of the adapter for the error a bridge stopped
+// with
+func ExitCode(err error) int {
+	stop, ok := err.(*stopError)
+	switch {
+	case !ok:
+		return exitOK
+	case stop.unclean:
+		return exitUnclean
+	case stop.reason == ErrDisengaged:
+		return exitDisengaged
+	case stop.reason == ErrNotEngaged:
+		return exitNotEngaged
+	}
+	return exitOK
+}
+
+const (
+	// how long the outbound side has to be quiet before it's considered
+	// drained
+	drainIdle = 500 * time.Millisecond
+	// how often to check whether priscilla took what was queued for it
+	flushPoll = 10 * time.Millisecond
+)
+
+// shutdown delivers whatever priscilla still has queued for hipchat, then
+// signs every account off and, unless the server is already gone, tells
+// priscilla the adapter is leaving. Returns false if any of it didn't finish
+// by deadlineAt, when deadline is closed.
+func shutdown(clients map[string]*client,
+	toPris chan<- *prisclient.Query, fromPris <-chan *prisclient.Query,
+	report failureReporter, deadlineAt time.Time, deadline <-chan struct{},
+	serverGone bool) bool {
+
+	clean := true
+
+	// a peer that stopped reading can't hold the shutdown up
+	setWriteDeadline(clients, deadlineAt)
+
+	if !serverGone {
+		logger.Info.Println("Draining outbound messages...")
+	drain:
+		for {
+			select {
+			case query := <-fromPris:
+				if query.Type == "message" && query.Message != nil {
+					deliver(clients, query.Message, report)
+				}
+			case <-time.After(drainIdle):
+				break drain
+			case <-deadline:
+				logger.Warn.Println("Timed out draining outbound messages")
+				clean = false
+				break drain
+			}
+		}
+	}
+
+	// what the rate limit held back is still sent, as time allows
+paced:
+	for _, hc := range clients {
+		for len(hc.outbox) > 0 {
+			select {
+			case <-time.After(hc.holdBack()):
+				queued := len(hc.outbox)
+				if hc.flush(report); len(hc.outbox) == queued {
+					// disconnected, it's discarded below
+					continue paced
+				}
+			case <-deadline:
+				logger.Warn.Println("Timed out sending rate limited messages")
+				clean = false
+				break paced
+			}
+		}
+	}
+
+	for _, hc := range clients {
+		hc.close(deadlineAt)
+	}
+	if time.Now().After(deadlineAt) {
+		logger.Warn.Println("Timed out signing off from HipChat")
+		clean = false
+	}
+	logger.Info.Println("Disconnected from HipChat")
+
+	if !serverGone {
+		for _, hc := range clients {
+			hc.discard("Adapter shutting down", report)
+		}
+	}
+
+	if !serverGone {
+		disengage := &prisclient.Query{
+			Type: "command",
+			To:   "server",
+			Command: &prisclient.CommandBlock{
+				Id:     prisclient.RandomId(),
+				Action: "disengage",
+			},
+		}
+
+		select {
+		case toPris <- disengage:
+			if flushed(toPris, deadline) {
+				logger.Info.Println("Disengaged from priscilla")
+				break
+			}
+			logger.Warn.Println("Timed out disengaging from priscilla")
+			clean = false
+		case <-deadline:
+			logger.Warn.Println("Timed out disengaging from priscilla")
+			clean = false
+		}
+	}
+
+	return clean
+}
+
+// flushed waits for priscilla to take everything queued for it, the
+// failure reports and the disengage included, until deadline is closed
+func flushed(toPris chan<- *prisclient.Query, deadline <-chan struct{}) bool {
+	for len(toPris) > 0 {
+		select {
+		case <-time.After(flushPoll):
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// setWriteDeadline bounds the writes of every account
+func setWriteDeadline(clients map[string]*client, deadline time.Time) {
+	for _, hc := range clients {
+		if conn := hc.conn(); conn != nil {
+			conn.SetWriteDeadline(deadline)
+		}
+	}
+}
+
+// close leaves all rooms and ends the stream, giving up on writing at
+// deadline unless it's zero. The client stops reconnecting, it can't be used
+// after.
+func (c *client) close(deadline time.Time) {
+	c.cancel()
+
+	conn := c.conn()
+	if conn == nil {
+		return
+	}
+	if !deadline.IsZero() {
+		conn.SetWriteDeadline(deadline)
+	}
+
+	if jid := c.login().jid; jid != "" {
+		c.leave(c.joinedRooms())
+		conn.Unavailable(jid)
+	}
+
+	conn.StreamEnd()
+	conn.Disconnect()
+}
+
+func (c *client) closing() bool {
+	return c.ctx.Err() != nil
+}
@@ -0,0 +1,328 @@
+// Package logging holds what the adapter's packages share about logging:
+// secret redaction, JSON log lines and logging events with fields.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/prislog"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// marks a log line that already carries its fields as JSON
+	structuredMark = "\x1e"
+)
+
+var (
+	logLevels = []string{"debug", "info", "warn", "error"}
+
+	redactPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(<auth\b[^>]*>)[^<]*(</auth>)`),
+		regexp.MustCompile(`(oauth2_token=')[^']*(')`),
+		regexp.MustCompile(`(oauth2_token=")[^"]*(")`),
+	}
+
+	// Secrets are redacted from all log output
+	Secrets = &Redactor{}
+
+	jsonLogs   bool
+	jsonLogsMu sync.RWMutex
+)
+
+// Fields are logged along with the message of an event
+type Fields map[string]string
+
+// Redactor scrubs known secrets (passwords, tokens) and auth elements from
+// log output
+type Redactor struct {
+	sync.RWMutex
+	values []string
+}
+
+// Add registers secret to be redacted, empty ones are ignored
+func (r *Redactor) Add(secret string) {
+	if secret == "" {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, value := range r.values {
+		if value == secret {
+			return
+		}
+	}
+	r.values = append(r.values, secret)
+}
+
+// Redact replaces the auth elements and registered secrets in line
+func (r *Redactor) Redact(line string) string {
+	for _, pattern := range redactPatterns {
+		line = pattern.ReplaceAllString(line, "${1}"+redacted+"${2}")
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, value := range r.values {
+		line = strings.Replace(line, value, redacted, -1)
+	}
+	return line
+}
+
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, Secrets.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonWriter turns every log line into a JSON object of its own
+type jsonWriter struct {
+	out   io.Writer
+	level string
+}
+
+func (w *jsonWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	entry := make(map[string]string)
+
+	if strings.HasPrefix(line, structuredMark) {
+		if err := json.Unmarshal([]byte(line[len(structuredMark):]),
+			&entry); err != nil {
+			entry = map[string]string{"msg": line[len(structuredMark):]}
+		}
+	} else {
+		entry["msg"] = line
+	}
+
+	for key, value := range entry {
+		entry[key] = Secrets.Redact(value)
+	}
+
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = w.level
+
+	// keep stanzas readable, no \u003c in place of <
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(entry); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.out.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// output is where the loggers of a PrisLog made by NewLogger write. It's
+// switched by Reconfigure while they're in use, writes in progress hold it.
+type output struct {
+	sync.RWMutex
+	out   io.Writer
+	level int
+	json  bool
+	// what prislog formats text lines with, by level
+	prefixes []string
+	flags    []int
+}
+
+// levelWriter passes what's logged at level on to the output
+type levelWriter struct {
+	output *output
+	level  int
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	w.output.RLock()
+	defer w.output.RUnlock()
+
+	switch {
+	case w.level < w.output.level:
+		return len(p), nil
+	case w.output.json:
+		return (&jsonWriter{
+			out:   w.output.out,
+			level: logLevels[w.level],
+		}).Write(p)
+	}
+	return (&redactWriter{out: w.output.out}).Write(p)
+}
+
+var (
+	outputs   = make(map[*prislog.PrisLog]*output)
+	outputsMu sync.Mutex
+)
+
+// NewLogger returns a logger writing to out, format is "text" or "json"
+func NewLogger(out io.Writer, level, format string) (*prislog.PrisLog, error) {
+	o := &output{
+		prefixes: make([]string, len(logLevels)),
+		flags:    make([]int, len(logLevels)),
+	}
+
+	// one prislog for each level, all enabled, each keeps its own
+	// formatting and only its level's logger
+	loggers := make([]*log.Logger, len(logLevels))
+	for i := range logLevels {
+		l, err := prislog.NewLogger(&levelWriter{output: o, level: i},
+			"debug")
+		if err != nil {
+			return nil, err
+		}
+		loggers[i] = []*log.Logger{l.Debug, l.Info, l.Warn, l.Error}[i]
+		o.prefixes[i] = loggers[i].Prefix()
+		o.flags[i] = loggers[i].Flags()
+	}
+
+	l := &prislog.PrisLog{
+		Debug: loggers[0],
+		Info:  loggers[1],
+		Warn:  loggers[2],
+		Error: loggers[3],
+		Level: level,
+	}
+
+	outputsMu.Lock()
+	outputs[l] = o
+	outputsMu.Unlock()
+
+	if err := Reconfigure(l, out, level, format); err != nil {
+		outputsMu.Lock()
+		delete(outputs, l)
+		outputsMu.Unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reconfigure switches a logger made by NewLogger to out, level and format
+// while it's in use. Once it returns nothing writes to the previous out.
+func Reconfigure(l *prislog.PrisLog, out io.Writer,
+	level, format string) error {
+
+	outputsMu.Lock()
+	o, ok := outputs[l]
+	outputsMu.Unlock()
+	if !ok {
+		return errors.New("Logger can't be reconfigured")
+	}
+
+	enabled := levelIndex(level)
+	if enabled < 0 {
+		return fmt.Errorf("Unknown log level: %s", level)
+	}
+
+	var structured bool
+	switch format {
+	case "", "text":
+	case "json":
+		structured = true
+	default:
+		return fmt.Errorf("Unknown log format: %s", format)
+	}
+
+	o.Lock()
+	o.out = out
+	o.level = enabled
+	o.json = structured
+	o.Unlock()
+
+	// the JSON lines have fields of their own for what prislog prefixes
+	for i, logger := range []*log.Logger{l.Debug, l.Info, l.Warn, l.Error} {
+		if structured {
+			logger.SetPrefix("")
+			logger.SetFlags(0)
+		} else {
+			logger.SetPrefix(o.prefixes[i])
+			logger.SetFlags(o.flags[i])
+		}
+	}
+
+	setJSONLogs(structured)
+	return nil
+}
+
+// Level returns the level l currently logs at, Level of the PrisLog is the
+// one it was made with
+func Level(l *prislog.PrisLog) string {
+	outputsMu.Lock()
+	o, ok := outputs[l]
+	outputsMu.Unlock()
+	if !ok {
+		return l.Level
+	}
+
+	o.RLock()
+	defer o.RUnlock()
+	return logLevels[o.level]
+}
+
+func levelIndex(level string) int {
+	for i, name := range logLevels {
+		if name == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func setJSONLogs(enabled bool) {
+	jsonLogsMu.Lock()
+	jsonLogs = enabled
+	jsonLogsMu.Unlock()
+}
+
+// Event logs msg along with fields, as key=value pairs in text mode and as
+// separate JSON fields in JSON mode
+func Event(l *log.Logger, msg string, fields Fields) {
+	jsonLogsMu.RLock()
+	structured := jsonLogs
+	jsonLogsMu.RUnlock()
+
+	if structured {
+		entry := make(map[string]string, len(fields)+1)
+		for key, value := range fields {
+			entry[key] = value
+		}
+		entry["msg"] = msg
+
+		out, err := json.Marshal(entry)
+		if err == nil {
+			l.Println(structuredMark + string(out))
+			return
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var line bytes.Buffer
+	line.WriteString(msg)
+	for _, key := range keys {
+		fmt.Fprintf(&line, " %s=%q", key, fields[key])
+	}
+	l.Println(line.String())
+}
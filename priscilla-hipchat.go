@@ -1,572 +1,497 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"flag"
 	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
 	"github.com/priscillachat/prisclient"
 	"github.com/priscillachat/prislog"
-	"github.com/tbruyelle/hipchat-go/hipchat"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"net/http"
 	"os"
-	"regexp"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
-const (
-	hipchatHost = "chat.hipchat.com"
-	hipchatConf = "conf.hipchat.com"
-)
-
-type hipchatClient struct {
-	username string
-	password string
-	resource string
-	id       string
-	nick     string
-
-	// private
-	usersByMention map[string]*hipchatUser
-	usersByName    map[string]*hipchatUser
-	usersByJid     map[string]*hipchatUser
-	usersByEmail   map[string]*hipchatUser
-	xmpp           *xmppConn
-	roomsByName    map[string]string
-	roomsById      map[string]string
-	host           string
-	jid            string
-	accountId      string
-	apiHost        string
-	chatHost       string
-	mucHost        string
-	webHost        string
-	token          string
-	mention        string
-	aMention       string
-	api            *hipchat.Client
-}
-
-type message struct {
-	From        string
-	To          string
-	Body        string
-	MentionName string
-}
-
-type xmppMessage struct {
-	XMLName  xml.Name `xml:"message"`
-	Type     string   `xml:"type,attr"`
-	From     string   `xml:"from,attr"`
-	FromJid  string   `xml:"from_jid,attr"`
-	To       string   `xml:"to,attr"`
-	Id       string   `xml:"id,attr"`
-	Body     string   `xml:"body"`
-	RoomName string   `xml:"x>name,omitempty"`
-	RoomId   string   `xml:"x>id,omitempty"`
-}
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
-type config struct {
-	Port     int                      `yaml:"port"`
-	Secret   string                   `yaml:"secret"`
-	Adapters map[string]adapterConfig `yaml:"adapters"`
-}
+var logger *prislog.PrisLog
 
-type adapterConfig struct {
-	Params map[string]*string `yaml:"params"`
+func usage() {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %s [command] [flags] [args]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without a command the adapter runs until stopped. "+
+		"Commands:")
+	for _, name := range []string{"send", "rooms", "whois", "check"} {
+		fmt.Fprintln(out, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
 }
 
-var logger *prislog.PrisLog
-
 func main() {
 
 	user := flag.String("user", "", "hipchat username")
-	pass := flag.String("pass", "", "hipchat password")
+	pass := flag.String("pass", "",
+		"hipchat password (visible in the process list, prefer -passfile "+
+			"or HIPCHAT_PASS)")
+	passFile := flag.String("passfile", "",
+		"file to read hipchat password from")
 	nick := flag.String("nick", "Priscilla", "hipchat full name")
 	server := flag.String("server", "127.0.0.1", "priscilla server")
 	port := flag.String("port", "4517", "priscilla server port")
 	sourceid := flag.String("id", "priscilla-hipchat", "source id")
 	loglevel := flag.String("loglevel", "warn", "loglevel")
-	secret := flag.String("secret", "abcdefg",
-		"secret for access priscilla server")
+	secret := flag.String("secret", defaultSecret,
+		"secret for access priscilla server (or PRISCILLA_SECRET)")
+	secretFile := flag.String("secretfile", "",
+		"file to read the priscilla server secret from")
+	allowDefaultSecret := flag.Bool("allowdefaultsecret", false,
+		"allow connecting with the default priscilla secret")
 	confFile := flag.String("conf", "",
 		"Priscilla config file, overrides command line options")
 	confName := flag.String("confname", "",
 		"Name of the config subsection (under \"adapters\")")
-	logfile := flag.String("logfile", "STDOUT", "Log file")
-
-	flag.Parse()
+	logfile := flag.String("logfile", "STDOUT",
+		"Log file, STDOUT or STDERR for standard output or error")
+	logformat := flag.String("logformat", "text", "Log format, text or json")
+	rooms := flag.String("rooms", "",
+		"comma separated rooms to join, all rooms when empty")
+	ratelimit := flag.String("ratelimit", "",
+		"minimum interval between outgoing messages, e.g. 500ms")
+	httpAddr := flag.String("http", "",
+		"address to serve metrics and health checks on, e.g. :9100, "+
+			"disabled when empty")
+	adminAddr := flag.String("admin", "",
+		"address to serve the admin API on, e.g. 127.0.0.1:9101, "+
+			"disabled when empty")
+	adminToken := flag.String("admintoken", "",
+		"token required by the admin API (or ADMIN_TOKEN)")
+	record := flag.String("record", "",
+		"file to record the stanzas of every connection to")
+	replay := flag.String("replay", "",
+		"replay a recorded session instead of connecting to hipchat")
+	replayOut := flag.String("replayout", "STDOUT",
+		"where a replay reports what would have been sent")
+	readOnly := flag.Bool("readonly", false,
+		"forward what's received but only log what would be sent")
+	shadowRoom := flag.String("shadowroom", "",
+		"room a read-only adapter sends to instead, e.g. account:room")
+	fileDir := flag.String("filedir", "",
+		"directory priscilla may share files from by path, disabled when empty")
+	fileLimit := flag.String("filelimit", "",
+		"size limit in bytes of the files shared, 10MB when empty")
+	stripANSI := flag.Bool("stripansi", false,
+		"remove ANSI escape sequences, e.g. colors, from the messages sent")
+	format := flag.String("format", "",
+		"how messages are converted from Markdown: none, text or html")
+	roomFormats := flag.String("roomformats", "",
+		"formats of rooms, e.g. Eng=html,ops:Build=text")
+	dropNotifications := flag.Bool("dropnotifications", false,
+		"don't forward the notifications integrations post in rooms")
+	consoleMode := flag.Bool("console", false,
+		"simulate hipchat on the terminal instead of connecting to it, "+
+			"lines typed are said in a room")
+	consoleUser := flag.String("consoleuser", "Console User",
+		"who the lines typed in console mode come from")
+	consoleRoom := flag.String("consoleroom", "Console",
+		"the room of console mode")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 10*time.Second,
+		"time allowed for a graceful shutdown")
+
+	flag.Usage = usage
+
+	// a command comes first, before the flags
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && commands[args[0]] != nil {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	var err error
-	var conf config
 
-	if *confFile != "" && *confName != "" {
-		confRaw, err := ioutil.ReadFile(*confFile)
-
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error reading conf file:", err)
-			os.Exit(1)
+	if *pass == "" {
+		if *passFile != "" {
+			*pass, err = readSecretFile("-passfile", *passFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error reading password file:", err)
+				os.Exit(1)
+			}
+		} else {
+			*pass = os.Getenv("HIPCHAT_PASS")
 		}
+	}
 
-		err = yaml.Unmarshal(confRaw, &conf)
-
+	if *secretFile != "" {
+		*secret, err = readSecretFile("-secretfile", *secretFile)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error parsing conf file:", err)
+			fmt.Fprintln(os.Stderr, "Error reading secret file:", err)
 			os.Exit(1)
 		}
+	} else if env := os.Getenv("PRISCILLA_SECRET"); env != "" &&
+		*secret == defaultSecret {
+		*secret = env
+	}
 
-		if conf.Port != 0 {
-			*port = fmt.Sprintf("%d", conf.Port)
-		}
+	reload := &reloader{
+		base: map[string]string{
+			"user":              *user,
+			"pass":              *pass,
+			"nick":              *nick,
+			"server":            *server,
+			"id":                *sourceid,
+			"loglevel":          *loglevel,
+			"logfile":           *logfile,
+			"logformat":         *logformat,
+			"rooms":             *rooms,
+			"ratelimit":         *ratelimit,
+			"http":              *httpAddr,
+			"admin":             *adminAddr,
+			"admintoken":        *adminToken,
+			"record":            *record,
+			"readonly":          strconv.FormatBool(*readOnly),
+			"shadowroom":        *shadowRoom,
+			"filedir":           *fileDir,
+			"filelimit":         *fileLimit,
+			"dropnotifications": strconv.FormatBool(*dropNotifications),
+			"format":            *format,
+			"roomformats":       *roomFormats,
+			"stripansi":         strconv.FormatBool(*stripANSI),
+		},
+		accounts: make(map[string]map[string]string),
+	}
+	params := reload.base
 
-		if conf.Secret != "" {
-			secret = &conf.Secret
-		}
+	if *confFile != "" && *confName != "" {
+		settings, err := loadAdapterConfig(*confFile, *confName)
 
-		if hcconf, ok := conf.Adapters[*confName]; ok {
-			for key, value := range hcconf.Params {
-				switch key {
-				case "user":
-					user = value
-				case "pass":
-					pass = value
-				case "nick":
-					nick = value
-				case "server":
-					server = value
-				case "id":
-					sourceid = value
-				case "loglevel":
-					loglevel = value
-				case "logfile":
-					logfile = value
-				}
+		if errs, ok := err.(configErrors); ok {
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, "Config error:", *confFile+":", err)
 			}
-		} else {
-			fmt.Fprintln(os.Stderr, *confName,
-				"is not found in config adapters section")
+			os.Exit(1)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-	}
 
-	var logwriter *os.File
+		if settings.port != 0 {
+			*port = fmt.Sprintf("%d", settings.port)
+		}
 
-	if *logfile == "STDOUT" {
-		logwriter = os.Stdout
-	} else {
-		logwriter, err = os.OpenFile(*logfile,
-			os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			fmt.Println("Unable to write to log file", *logfile, ":", err)
-			os.Exit(1)
+		if settings.secret != "" {
+			*secret = settings.secret
 		}
-		defer logwriter.Close()
+
+		params = mergeParams(reload.base, settings.params)
+
+		reload.confFile = *confFile
+		reload.confName = *confName
+		reload.port = settings.port
+		reload.secret = settings.secret
+		reload.accounts = settings.accounts
 	}
 
-	logger, err = prislog.NewLogger(logwriter, *loglevel)
+	reload.params = params
 
-	if err != nil {
-		fmt.Println("Error initializing logger: ", err)
-		os.Exit(-1)
+	if *secret == defaultSecret && !*allowDefaultSecret && *replay == "" &&
+		command == "" {
+		fmt.Fprintln(os.Stderr, "Refusing to start with the default priscilla "+
+			"secret, configure a secret or pass -allowdefaultsecret")
+		os.Exit(1)
 	}
 
-	hc := &hipchatClient{
-		username: *user,
-		password: *pass,
-		resource: "bot",
-		id:       *user + "@" + hipchatHost,
-		nick:     *nick,
-
-		xmpp:           nil,
-		usersByMention: make(map[string]*hipchatUser),
-		usersByJid:     make(map[string]*hipchatUser),
-		usersByName:    make(map[string]*hipchatUser),
-		usersByEmail:   make(map[string]*hipchatUser),
-		host:           hipchatHost,
-		roomsByName:    make(map[string]string),
-		roomsById:      make(map[string]string),
+	// keep the output of a command apart from the log
+	if command != "" && params["logfile"] == "STDOUT" {
+		params["logfile"] = "STDERR"
 	}
 
-	priscilla, err := prisclient.NewClient(*server, *port, "adapter",
-		*sourceid, *secret, true, logger)
+	reload.logwriter, logger, err = openLog(params["logfile"],
+		params["loglevel"], params["logformat"])
 
 	if err != nil {
-		logger.Error.Println("Failed to create priscilla-hipchate:", err)
-		os.Exit(2)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	// quit := make(chan int)
-
-	run(priscilla, hc)
-	// go hc.keepAlive()
-
-	// <-quit
-}
-
-func (c *hipchatClient) initialize() error {
-	c.xmpp.StreamStart(c.id, c.host)
-	for {
-		element, err := c.xmpp.RecvNext()
+	if params["admintoken"] == "" {
+		params["admintoken"] = os.Getenv("ADMIN_TOKEN")
+	}
 
+	logging.Secrets.Add(*secret)
+	logging.Secrets.Add(params["admintoken"])
+
+	var accounts []hipchat.Account
+	var replayer *replayOutput
+	var replayFile *os.File
+	var rec *recorder
+	var cons *console
+
+	if *consoleMode {
+		cons = newConsole(params["nick"], *consoleUser, *consoleRoom,
+			os.Stdout)
+		accounts = append(accounts, hipchat.Account{
+			User: "console",
+			Nick: params["nick"],
+			Dial: cons.server.Dial,
+		})
+	} else if *replay != "" {
+		// the recording decides which accounts there are, no credentials
+		// needed
+		recorded, err := loadRecording(*replay)
 		if err != nil {
-			return err
+			logger.Error.Println("Failed to load recording:", err)
+			os.Exit(1)
 		}
 
-		switch element.Name.Local + element.Name.Space {
-		case "stream" + xmppNsStream:
-			features := c.xmpp.RecvFeatures()
-			if features.StartTLS != nil {
-				c.xmpp.StartTLS()
-			} else {
-				info, err := c.xmpp.Auth(c.username, c.password, c.resource)
-				if err != nil {
-					return err
-				}
-				c.jid = info.Jid
-				c.accountId = strings.Split(c.jid, "_")[0]
-				c.apiHost = info.ApiHost
-				c.chatHost = info.ChatHost
-				c.mucHost = info.MucHost
-				c.webHost = info.WebHost
-				c.token = info.Token
-				c.api = hipchat.NewClient(c.token)
-				logger.Debug.Println("JID:", c.jid)
-				logger.Debug.Println("Token:", info.Token)
-				return nil
+		out := os.Stdout
+		if *replayOut != "STDOUT" {
+			replayFile, err = os.Create(*replayOut)
+			if err != nil {
+				logger.Error.Println("Failed to create replay output:", err)
+				os.Exit(1)
 			}
-		case "proceed" + xmppNsTLS:
-			c.xmpp.UseTLS(c.host)
-			c.xmpp.StreamStart(c.id, c.host)
-			if logger.Level == "debug" {
-				c.xmpp.Debug()
+			out = replayFile
+		}
+		replayer = newReplayOutput(out)
+
+		for name, session := range recorded {
+			accNick := params["nick"]
+			if reload.accounts[name]["nick"] != "" {
+				accNick = reload.accounts[name]["nick"]
 			}
+			source := &replaySource{session: session}
+			accounts = append(accounts, hipchat.Account{
+				Name:           name,
+				User:           "replay",
+				Nick:           accNick,
+				Taps:           []xmpp.StanzaTap{replayer.tap(name)},
+				Dial:           source.connect,
+				ReconnectDelay: time.Millisecond,
+			})
+		}
+	} else {
+		if params["user"] != "" {
+			accounts = append(accounts, hipchat.Account{
+				User:     params["user"],
+				Password: params["pass"],
+				Nick:     params["nick"],
+			})
 		}
 
+		for name, accParams := range reload.accounts {
+			accNick := params["nick"]
+			if accParams["nick"] != "" {
+				accNick = accParams["nick"]
+			}
+			accounts = append(accounts, hipchat.Account{
+				Name:     name,
+				User:     accParams["user"],
+				Password: accParams["pass"],
+				Nick:     accNick,
+			})
+		}
 	}
-	return nil
-}
 
-func (c *hipchatClient) populateUser(jid string) error {
-	idFull := strings.Split(jid, "@")[0]
-	id := strings.Split(idFull, "_")[1]
-	user, _, err := c.api.User.View(id)
+	if params["record"] != "" {
+		rec, err = newRecorder(params["record"])
+		if err != nil {
+			logger.Error.Println("Failed to open recording:", err)
+			os.Exit(1)
+		}
 
-	if err != nil {
-		return err
+		for i := range accounts {
+			accounts[i].Taps = append(accounts[i].Taps,
+				rec.tap(accounts[i].Name))
+		}
 	}
 
-	logger.Debug.Println("User found:", user)
-	hcUser := &hipchatUser{
-		Jid:     user.XmppJid,
-		Name:    user.Name,
-		Mention: user.MentionName,
-		Email:   user.Email,
+	for i := range accounts {
+		account := &accounts[i]
+		account.Rooms, account.RateLimit, err = clientSettings(params,
+			reload.accounts[account.Name])
+		if err != nil {
+			logger.Error.Println(err)
+			os.Exit(1)
+		}
+		reload.live = append(reload.live, account.Name)
 	}
-	c.usersByMention[hcUser.Mention] = hcUser
-	c.usersByName[hcUser.Name] = hcUser
-	c.usersByJid[hcUser.Jid] = hcUser
-	c.usersByEmail[hcUser.Email] = hcUser
 
-	return nil
-}
-
-func (c *hipchatClient) keepAlive(trigger chan<- bool) {
-	for _ = range time.Tick(60 * time.Second) {
-		trigger <- true
+	if command != "" {
+		// there's no bridge to hand the logger to
+		hipchat.SetLogger(logger)
+		code := runCommand(command, accounts, flag.Args())
+		if rec != nil {
+			rec.close()
+		}
+		reload.close()
+		os.Exit(code)
 	}
-}
 
-func run(priscilla *prisclient.Client, hc *hipchatClient) {
+	var priscilla hipchat.Priscilla
 
-	messageFromHC := make(chan *xmppMessage)
-	go hc.listen(messageFromHC)
-
-	fromPris := make(chan *prisclient.Query)
-	toPris := make(chan *prisclient.Query)
-	go priscilla.Run(toPris, fromPris)
-
-	keepAlive := make(chan bool)
-	go hc.keepAlive(keepAlive)
-
-mainLoop:
-	for {
-		select {
-		case msg := <-messageFromHC:
-			logger.Debug.Println("Type:", msg.Type)
-			logger.Debug.Println("From:", msg.From)
-			logger.Debug.Println("Message:", msg.Body)
-			logger.Debug.Println("Room Invite:", msg.RoomName)
-
-			fromSplit := strings.Split(msg.From, "/")
-			fromRoom := fromSplit[0]
-			var fromNick string
-			if len(fromSplit) > 1 {
-				fromNick = fromSplit[1]
-			}
-
-			if msg.FromJid != "" {
-				if _, exist := hc.usersByJid[msg.FromJid]; !exist {
-					// hc.xmpp.VCardRequest(hc.jid, msg.FromJid)
-					hc.populateUser(msg.FromJid)
-				}
-			}
+	if replayer != nil {
+		priscilla = replayer
+	} else {
+		client, err := prisclient.NewClient(params["server"], *port,
+			"adapter", params["id"], *secret, true, logger)
 
-			if msg.Body != "" && fromNick != hc.nick {
-				mentioned, err := regexp.MatchString("@"+hc.mention, msg.Body)
-				if err != nil {
-					logger.Error.Println("Error searching for mention:", err)
-				}
-
-				clientQuery := prisclient.Query{
-					Type: "message",
-					To:   "server",
-					Message: &prisclient.MessageBlock{
-						Message:   msg.Body,
-						From:      fromNick,
-						Room:      hc.roomsById[fromRoom],
-						Mentioned: mentioned,
-						Stripped: strings.Replace(msg.Body, hc.aMention,
-							"", -1),
-					},
-				}
-
-				if mentioned {
-					clientQuery.Message.Message = strings.Replace(msg.Body,
-						"@"+hc.mention, "", -1)
-				}
-
-				if user, exists := hc.usersByName[fromNick]; exists {
-					clientQuery.Message.User = &prisclient.UserInfo{
-						Id:      user.Jid,
-						Name:    user.Name,
-						Mention: user.Mention,
-						Email:   user.Email,
-					}
-				}
-
-				toPris <- &clientQuery
-			} else if msg.RoomName != "" {
-				hc.roomsByName[msg.RoomName] = msg.From
-				hc.roomsById[msg.From] = msg.RoomName
-				hc.xmpp.Join(hc.jid, hc.nick, []string{msg.From})
-			}
-		case query := <-fromPris:
-			logger.Debug.Println("Query received:", *query)
-			switch {
-			case query.Type == "command":
-				switch query.Command.Action {
-				case "disengage":
-					// either server forcing disengage or server connection lost
-					logger.Warn.Println("Disengage received, terminating...")
-					break mainLoop
-				case "user_request":
-					fallthrough
-				case "room_request":
-					response := prisclient.Query{
-						Type: "command",
-						To:   query.Source,
-						Command: &prisclient.CommandBlock{
-							Id:     query.Command.Id,
-							Action: "info",
-							Map:    map[string]string{},
-						},
-					}
-					if query.Command.Action == "user_request" {
-						var user *hipchatUser
-						var exists bool
-
-						response.Command.Type = "user"
-						switch query.Command.Type {
-						case "user":
-							user, exists = hc.usersByName[query.Command.Data]
-						case "mention":
-							user, exists = hc.usersByMention[query.Command.Data]
-						case "email":
-							user, exists = hc.usersByEmail[query.Command.Data]
-						case "id":
-							user, exists = hc.usersByJid[query.Command.Data]
-						}
-						if exists {
-							response.Command.Map["id"] = user.Jid
-							response.Command.Map["name"] = user.Name
-							response.Command.Map["mention"] = user.Mention
-							response.Command.Map["email"] = user.Email
-						} else {
-							response.Command.Error = "User not found"
-						}
-					} else {
-						response.Command.Type = "room"
-						switch query.Command.Type {
-						case "name":
-							id, exists := hc.roomsByName[query.Command.Data]
-							if exists {
-								response.Command.Map["id"] = id
-								response.Command.Map["name"] = query.Command.Data
-							} else {
-								response.Command.Error = "Room not found"
-							}
-						case "id":
-							name, exists := hc.roomsById[query.Command.Data]
-							if exists {
-								response.Command.Map["name"] = name
-								response.Command.Map["id"] = query.Command.Data
-							} else {
-								response.Command.Error = "Room not found"
-							}
-						}
-					}
-					toPris <- &response
-				}
-			case query.Type == "message":
-				hc.groupMessage(query.Message)
-				// hc.groupMessage(hc.roomsByName[query.Message.Room],
-				//  query.Message.Message)
-			}
-		case <-keepAlive:
-			hc.xmpp.KeepAlive()
-			logger.Debug.Println("KeepAlive sent")
-			// within 60 seconds of token expiration
-			// if hc.tokenExp < time.Now().Unix()+60 {
-			// if true {
-			//  hc.xmpp.AuthRequest(hc.username, hc.password, hc.resource)
-			//  logger.Info.Println("New token requested")
-			// }
+		if err != nil {
+			logger.Error.Println("Failed to create priscilla-hipchate:", err)
+			os.Exit(2)
 		}
+		priscilla = hipchat.PriscillaClient{Client: client}
 	}
-}
-
-func (c *hipchatClient) groupMessage(message *prisclient.MessageBlock) error {
 
-	xmppMsg := xmppMessage{
-		From: c.jid,
-		To:   c.roomsByName[message.Room] + "/" + c.nick,
-		Id:   prisclient.RandomId(),
-		Type: "groupchat",
-		Body: message.Message,
+	readOnlyMode, err := parseBool(params["readonly"])
+	if err != nil {
+		logger.Error.Println("readonly:", err)
+		os.Exit(1)
 	}
 
-	if len(message.MentionNotify) > 0 {
-		for _, name := range message.MentionNotify {
-			if user, ok := c.usersByName[name]; ok {
-				xmppMsg.Body += " @" + user.Mention
-			}
-		}
+	maxFileSize, err := parseSize(params["filelimit"])
+	if err != nil {
+		logger.Error.Println("filelimit:", err)
+		os.Exit(1)
 	}
-	return c.xmpp.Encode(&xmppMsg)
-}
-
-func (c *hipchatClient) establishConnection() error {
-	var err error
-
-	c.xmpp, err = xmppConnect(hipchatHost)
 
+	dropNotificationsMode, err := parseBool(params["dropnotifications"])
 	if err != nil {
-		logger.Error.Println("Error connecting to hipchat:", err)
-		return err
+		logger.Error.Println("dropnotifications:", err)
+		os.Exit(1)
 	}
 
-	logger.Info.Println("Connected to HipChat")
-
-	err = c.initialize()
-
+	stripANSIMode, err := parseBool(params["stripansi"])
 	if err != nil {
-		logger.Error.Println("Failed to initialize HipChat connection:", err)
-		return err
+		logger.Error.Println("stripansi:", err)
+		os.Exit(1)
 	}
-	logger.Info.Println("Authenticated")
-
-	c.xmpp.VCardRequest(c.jid, "")
-	self, err := c.xmpp.VCardDecode(nil)
 
+	formats, err := parseFormats(params["roomformats"])
 	if err != nil {
-		logger.Error.Println("Failed to retrieve info on myself:", err)
-		return err
+		logger.Error.Println("roomformats:", err)
+		os.Exit(1)
 	}
 
-	c.mention = self.Mention
-	c.aMention = "@" + self.Mention
-
-	self.Jid = c.jid
-
-	c.updateUserInfo(self)
-
-	rooms := c.xmpp.Discover(c.jid, c.mucHost)
-
-	autojoin := make([]string, 0, len(rooms))
+	connected := make(chan string, 1)
+
+	bridge, err := hipchat.New(hipchat.Options{
+		Accounts:          accounts,
+		Priscilla:         priscilla,
+		Logger:            logger,
+		Version:           version,
+		ShutdownTimeout:   *shutdownTimeout,
+		ReadOnly:          readOnlyMode,
+		ShadowRoom:        params["shadowroom"],
+		MaxFileSize:       maxFileSize,
+		FileDir:           params["filedir"],
+		DropNotifications: dropNotificationsMode,
+		Format:            params["format"],
+		RoomFormats:       formats,
+		StripANSI:         stripANSIMode,
+		OnConnected: func(account string) {
+			select {
+			case connected <- account:
+			default:
+			}
+		},
+		OnReload: func() {
+			if err := reload.reload(); err != nil {
+				logger.Error.Println("Reload failed:", err)
+			}
+		},
+	})
 
-	for _, room := range rooms {
-		c.roomsByName[room.Name] = room.Id
-		c.roomsById[room.Id] = room.Name
-		autojoin = append(autojoin, room.Id)
+	if err != nil {
+		logger.Error.Println(err)
+		os.Exit(1)
 	}
-
-	c.xmpp.Join(c.jid, c.nick, autojoin)
-	c.xmpp.Available(c.jid)
-
-	return nil
-}
-
-func (c *hipchatClient) listen(msgChan chan<- *xmppMessage) {
-
-	for err := c.establishConnection(); err != nil; err = c.establishConnection() {
-		logger.Error.Println("Failed to establish connection with hipchat:", err)
-		logger.Warn.Println("Sleeping 10 seconds before retry...")
-		c.xmpp.Disconnect()
-		time.Sleep(10 * time.Second)
+	reload.bridge = bridge
+
+	if params["http"] != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", hipchat.MetricsHandler())
+		mux.Handle("/healthz", bridge.LiveHandler())
+		mux.Handle("/readyz", bridge.ReadyHandler())
+
+		go func() {
+			err := http.ListenAndServe(params["http"], mux)
+			logger.Error.Println("HTTP listener failed:", err)
+		}()
 	}
 
-	for {
-		element, err := c.xmpp.RecvNext()
+	if params["admin"] != "" {
+		admin, err := bridge.AdminHandler(params["admin"],
+			params["admintoken"])
 
 		if err != nil {
 			logger.Error.Println(err)
-			c.xmpp.Disconnect()
-
-			for err := c.establishConnection(); err != nil; err = c.establishConnection() {
-				logger.Error.Println(
-					"Failed to establish connection with hipchat:", err)
-				logger.Warn.Println("Sleeping 10 seconds before retry...")
-				c.xmpp.Disconnect()
-				time.Sleep(10 * time.Second)
-			}
-			continue
+			os.Exit(1)
 		}
 
-		switch element.Name.Local {
-		case "message":
-			message := new(xmppMessage)
-			c.xmpp.DecodeElement(message, &element)
-			msgChan <- message
-
-			logger.Debug.Println(*message)
-		case "iq":
-			userInfo, err := c.xmpp.VCardDecode(&element)
-			if err == nil {
-				c.updateUserInfo(userInfo)
-			} else {
-				logger.Error.Println("Error decoding user vCard:", err)
+		go func() {
+			err := http.ListenAndServe(params["admin"], admin)
+			logger.Error.Println("Admin API listener failed:", err)
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				logger.Warn.Println("Received", sig.String()+
+					", shutting down...")
+				cancel()
+				return
+			}
+			if err := reload.reload(); err != nil {
+				logger.Error.Println("Reload failed:", err)
 			}
-		// case "success":
-		//  var auth authResponse
-		//  c.xmpp.AuthResp(&auth, &element)
-		//  if auth.Token != "" {
-		//   c.token = auth.Token
-		//   c.tokenExp = time.Now().Unix() + 2592000
-		//   logger.Debug.Println("New token:", c.token)
-		//  }
-		default:
-			c.xmpp.Skip()
 		}
+	}()
 
+	if err := bridge.Start(ctx); err != nil {
+		logger.Error.Println(err)
+		os.Exit(1)
 	}
-}
 
-func (c *hipchatClient) updateUserInfo(info *hipchatUser) {
-	c.usersByMention[info.Mention] = info
-	c.usersByJid[info.Jid] = info
-	c.usersByName[info.Name] = info
-	c.usersByEmail[info.Email] = info
+	if cons != nil {
+		go func() {
+			select {
+			case <-connected:
+			case <-bridge.Done():
+				return
+			}
+			if err := cons.read(os.Stdin, os.Stdout); err != nil {
+				logger.Error.Println("Console:", err)
+			}
+			logger.Warn.Println("Console closed, shutting down...")
+			cancel()
+		}()
+	}
+
+	err = bridge.Wait()
+	signal.Stop(signals)
+	cancel()
+	logger.Info.Println("Stopped:", err)
 
-	logger.Debug.Println("User info obtained:", *info)
+	code := hipchat.ExitCode(err)
+
+	if rec != nil {
+		rec.close()
+	}
+	if replayFile != nil {
+		replayFile.Close()
+	}
+	reload.close()
+	os.Exit(code)
 }
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stanzaRecord is one line of a recording
+type stanzaRecord struct {
+	Time      string `json:"time"`
+	Account   string `json:"account,omitempty"`
+	Direction string `json:"direction"`
+	Stanza    string `json:"stanza"`
+}
+
+// recorder writes the stanzas of every connection it taps to a file, one
+// JSON object per line
+type recorder struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newRecorder(file string) (*recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetEscapeHTML(false)
+
+	return &recorder{file: f, encoder: encoder}, nil
+}
+
+func (r *recorder) tap(account string) xmpp.StanzaTap {
+	return func(direction, stanza string) {
+		r.Lock()
+		defer r.Unlock()
+
+		err := r.encoder.Encode(&stanzaRecord{
+			Time:      time.Now().Format(time.RFC3339Nano),
+			Account:   account,
+			Direction: direction,
+			Stanza:    logging.Secrets.Redact(stanza),
+		})
+
+		if err != nil {
+			logger.Error.Println("Failed to record stanza:", err)
+		}
+	}
+}
+
+func (r *recorder) close() {
+	r.Lock()
+	r.file.Close()
+	r.Unlock()
+}
+
+// session is the recorded side of one account's connections
+type session struct {
+	// what was received, in order
+	inbound []string
+	// the ids of the iq requests sent, by what they asked for
+	requests map[string][]string
+}
+
+// loadRecording reads a recording and returns the session of each account
+func loadRecording(file string) (map[string]*session, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sessions := make(map[string]*session)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		var record stanzaRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line, err)
+		}
+
+		s, ok := sessions[record.Account]
+		if !ok {
+			s = &session{requests: make(map[string][]string)}
+			sessions[record.Account] = s
+		}
+
+		switch record.Direction {
+		case "in":
+			s.inbound = append(s.inbound, record.Stanza)
+		case "out":
+			for _, request := range iqRequests(record.Stanza) {
+				s.requests[request.key] = append(s.requests[request.key],
+					request.id)
+			}
+		}
+	}
+
+	return sessions, scanner.Err()
+}
+
+// replaySource plays the recorded inbound side of a session back, once
+type replaySource struct {
+	session *session
+	used    bool
+}
+
+func (r *replaySource) connect() (*xmpp.Conn, error) {
+	if r.used {
+		return nil, hipchat.ErrNoMoreConnections
+	}
+	r.used = true
+
+	return xmpp.NewConn(newReplayConn(r.session)), nil
+}
+
+var (
+	iqTag      = regexp.MustCompile(`<iq\b[^>]*>`)
+	iqType     = regexp.MustCompile(`\stype=["']([^"']*)["']`)
+	iqId       = regexp.MustCompile(`\sid=["']([^"']*)["']`)
+	iqTo       = regexp.MustCompile(`\sto=["']([^"']*)["']`)
+	iqPayload  = regexp.MustCompile(`^\s*<\w+[^>]*\sxmlns=["']([^"']*)["']`)
+	oauthToken = regexp.MustCompile(`\soauth2_token=["'][^"']*["']`)
+)
+
+// iqRequest is an iq get or set found in the stream, key is what it asks
+// for, so the requests of a replay can be told apart the way they were in
+// the recording
+type iqRequest struct {
+	id, key string
+}
+
+func attr(re *regexp.Regexp, tag string) string {
+	if match := re.FindStringSubmatch(tag); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// iqRequests returns the iq requests in data
+func iqRequests(data string) []iqRequest {
+	var requests []iqRequest
+
+	for _, loc := range iqTag.FindAllStringIndex(data, -1) {
+		tag := data[loc[0]:loc[1]]
+		typ := attr(iqType, tag)
+		if typ != "get" && typ != "set" {
+			continue
+		}
+		requests = append(requests, iqRequest{
+			id: attr(iqId, tag),
+			key: typ + " " + attr(iqTo, tag) + " " +
+				attr(iqPayload, data[loc[1]:]),
+		})
+	}
+
+	return requests
+}
+
+// iqReplyId returns the location of the id of stanza when it's an iq reply
+func iqReplyId(stanza string) ([]int, bool) {
+	tag := iqTag.FindStringIndex(stanza)
+	if tag == nil || strings.TrimSpace(stanza[:tag[0]]) != "" {
+		return nil, false
+	}
+
+	typ := attr(iqType, stanza[tag[0]:tag[1]])
+	if typ != "result" && typ != "error" {
+		return nil, false
+	}
+
+	id := iqId.FindStringSubmatchIndex(stanza[tag[0]:tag[1]])
+	if id == nil {
+		return nil, false
+	}
+	return []int{tag[0] + id[2], tag[0] + id[3]}, true
+}
+
+// withoutTLS drops the STARTTLS negotiation from a recording, which is
+// already decrypted: the features offering it up to the stream restarted
+// after the server proceeded
+func withoutTLS(stanzas []string) []string {
+	var kept []string
+
+	for i := 0; i < len(stanzas); i++ {
+		stanza := stanzas[i]
+		if strings.HasPrefix(stanza, "<stream:features") &&
+			strings.Contains(stanza, "<starttls") {
+			for i+1 < len(stanzas) &&
+				!strings.HasPrefix(stanzas[i+1], "<stream:stream") {
+				i++
+			}
+			i++
+			continue
+		}
+		kept = append(kept, stanza)
+	}
+
+	return kept
+}
+
+// replayConn is a net.Conn reading from a recording. Every Read returns at
+// most one stanza. The ids of the iq requests the adapter writes are paired
+// with the recorded ones, and a recorded reply to a request is held back
+// until the adapter sent it, for up to xmpp.IqTimeout, then passed on with
+// the id of the replay. Anything else, including replies to requests the
+// adapter never made, is passed on right away. The token given at login is
+// dropped, a replay never calls the REST API. Writes are discarded.
+type replayConn struct {
+	stanzas []string
+	current []byte
+	// the recorded ids of the requests
+	recorded map[string]bool
+
+	mu sync.Mutex
+	// the recorded ids no request was paired with yet, by key
+	unpaired map[string][]string
+	// the ids of the replay by recorded id
+	ids       map[string]string
+	requested chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplayConn(s *session) *replayConn {
+	r := &replayConn{
+		stanzas:   withoutTLS(s.inbound),
+		recorded:  make(map[string]bool),
+		unpaired:  make(map[string][]string),
+		ids:       make(map[string]string),
+		requested: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	for key, ids := range s.requests {
+		r.unpaired[key] = ids
+		for _, id := range ids {
+			r.recorded[id] = true
+		}
+	}
+
+	return r
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.isClosed() || len(r.stanzas) == 0 {
+			return 0, io.EOF
+		}
+		r.current = []byte(r.replay(r.stanzas[0]))
+		r.stanzas = r.stanzas[1:]
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// replay returns a recorded stanza the way it's read in the replay
+func (r *replayConn) replay(stanza string) string {
+	if loc, ok := iqReplyId(stanza); ok && r.recorded[stanza[loc[0]:loc[1]]] {
+		if id, ok := r.awaitRequest(stanza[loc[0]:loc[1]]); ok {
+			stanza = stanza[:loc[0]] + id + stanza[loc[1]:]
+		}
+	}
+
+	if strings.HasPrefix(stanza, "<success") {
+		stanza = oauthToken.ReplaceAllString(stanza, "")
+	}
+
+	return stanza
+}
+
+// awaitRequest waits for the request paired with a recorded id and returns
+// its id
+func (r *replayConn) awaitRequest(recorded string) (string, bool) {
+	timeout := time.After(xmpp.IqTimeout)
+	for {
+		r.mu.Lock()
+		id, ok := r.ids[recorded]
+		r.mu.Unlock()
+		if ok {
+			return id, true
+		}
+
+		select {
+		case <-r.requested:
+		case <-r.done:
+			return "", false
+		case <-timeout:
+			logger.Warn.Println("No request sent for the recorded reply",
+				recorded)
+			return "", false
+		}
+	}
+}
+
+func (r *replayConn) Write(p []byte) (int, error) {
+	if r.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+
+	requests := iqRequests(string(p))
+	if len(requests) == 0 {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	for _, request := range requests {
+		if unpaired := r.unpaired[request.key]; len(unpaired) > 0 {
+			r.ids[unpaired[0]] = request.id
+			r.unpaired[request.key] = unpaired[1:]
+		}
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.requested <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (r *replayConn) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
+
+func (r *replayConn) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (r *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (r *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (r *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (r *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayOutput is where a replay reports what the adapter sends, both to
+// hipchat and to priscilla
+type replayOutput struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+type replayEvent struct {
+	Account   string            `json:"account,omitempty"`
+	Direction string            `json:"direction"`
+	Stanza    string            `json:"stanza,omitempty"`
+	Query     *prisclient.Query `json:"query,omitempty"`
+}
+
+func newReplayOutput(out io.Writer) *replayOutput {
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	return &replayOutput{encoder: encoder}
+}
+
+func (o *replayOutput) write(event *replayEvent) {
+	o.Lock()
+	o.encoder.Encode(event)
+	o.Unlock()
+}
+
+func (o *replayOutput) tap(account string) xmpp.StanzaTap {
+	return func(direction, stanza string) {
+		if direction == "out" {
+			o.write(&replayEvent{
+				Account:   account,
+				Direction: "to_hipchat",
+				Stanza:    logging.Secrets.Redact(stanza),
+			})
+		}
+	}
+}
+
+// Run stands in for the priscilla connection during a replay, it reports
+// the queries the adapter sends and never sends any itself
+func (o *replayOutput) Run(ctx context.Context,
+	toPris <-chan *prisclient.Query, fromPris chan<- *prisclient.Query) {
+
+	for {
+		select {
+		case query := <-toPris:
+			o.write(&replayEvent{Direction: "to_priscilla", Query: query})
+		case <-ctx.Done():
+			// report what's left
+			for {
+				select {
+				case query := <-toPris:
+					o.write(&replayEvent{Direction: "to_priscilla",
+						Query: query})
+				default:
+					return
+				}
+			}
+		}
+	}
+}
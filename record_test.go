@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"github.com/priscillachat/priscilla-hipchat/hipchat/hipchattest"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/priscilla-hipchat/xmpp"
+	"github.com/priscillachat/prisclient"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// record runs a session against a test server, with Alice saying hello in
+// Eng, and records it to file
+func record(ctx context.Context, t *testing.T, file string) {
+	rec, err := newRecorder(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.close()
+
+	alice := xmpp.User{
+		Jid:     "1_3@chat.hipchat.com",
+		Name:    "Alice",
+		Mention: "alice",
+	}
+	server := &hipchattest.Server{
+		Bot: xmpp.User{
+			Jid:     "1_2@chat.hipchat.com",
+			Name:    "Priscilla",
+			Mention: "priscilla",
+		},
+		Users: []xmpp.User{alice},
+		Rooms: []xmpp.Room{{Id: "1_eng@conf.hipchat.com", Name: "Eng"}},
+	}
+	p := hipchattest.NewPriscilla()
+
+	connected := make(chan struct{}, 1)
+	bridge, err := hipchat.New(hipchat.Options{
+		Accounts: []hipchat.Account{{
+			User:     "1_2",
+			Password: "secret",
+			Nick:     "Priscilla",
+			Dial:     server.Dial,
+			Taps:     []xmpp.StanzaTap{rec.tap("")},
+		}},
+		Priscilla: p,
+		OnConnected: func(account string) {
+			connected <- struct{}{}
+		},
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bridge.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		bridge.Stop()
+		bridge.Wait()
+	}()
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("Not connected:", ctx.Err())
+	}
+
+	if err := server.Say(alice.Name, "Eng", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Wait(ctx, func(query *prisclient.Query) bool {
+		return query.Type == "message"
+	})
+	if err != nil {
+		t.Fatal("Message not forwarded while recording:", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var err error
+	logger, err = logging.NewLogger(ioutil.Discard, "error", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "priscilla-hipchat-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.jsonl")
+
+	record(ctx, t, file)
+
+	recorded, err := loadRecording(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded[""] == nil {
+		t.Fatal("Nothing recorded")
+	}
+
+	var out bytes.Buffer
+	replayer := newReplayOutput(&out)
+	source := &replaySource{session: recorded[""]}
+
+	bridge, err := hipchat.New(hipchat.Options{
+		Accounts: []hipchat.Account{{
+			User:           "replay",
+			Nick:           "Priscilla",
+			Taps:           []xmpp.StanzaTap{replayer.tap("")},
+			Dial:           source.connect,
+			ReconnectDelay: time.Millisecond,
+		}},
+		Priscilla:       replayer,
+		ShutdownTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bridge.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replay ends with the recording, replies nothing asked for are
+	// passed on without waiting for a request
+	select {
+	case <-bridge.Done():
+	case <-ctx.Done():
+		bridge.Stop()
+		bridge.Wait()
+		t.Fatal("Replay still running:", ctx.Err())
+	}
+	bridge.Wait()
+
+	forwarded := false
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var event replayEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Direction == "to_priscilla" && event.Query != nil &&
+			event.Query.Message != nil {
+			message := event.Query.Message
+			if message.Message == "hello" && message.From == "Alice" {
+				forwarded = true
+			}
+		}
+	}
+	if !forwarded {
+		t.Errorf("Message not forwarded in the replay:\n%s", out.String())
+	}
+}
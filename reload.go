@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/hipchat"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/prislog"
+	"os"
+	"strings"
+	"time"
+)
+
+// settings that can't be changed without reconnecting
+var restartParams = []string{"user", "pass", "nick", "server", "id", "http",
+	"admin", "admintoken", "record", "readonly", "shadowroom", "filedir",
+	"filelimit", "dropnotifications", "format", "roomformats", "stripansi"}
+
+type reloader struct {
+	confFile  string
+	confName  string
+	base      map[string]string
+	port      int
+	secret    string
+	params    map[string]string
+	accounts  map[string]map[string]string
+	logwriter *os.File
+	bridge    *hipchat.Bridge
+	// accounts the bridge runs
+	live []string
+}
+
+func mergeParams(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+	return merged
+}
+
+func openLogFile(logfile string) (*os.File, error) {
+	switch logfile {
+	case "STDOUT":
+		return os.Stdout, nil
+	case "STDERR":
+		return os.Stderr, nil
+	}
+
+	logwriter, err := os.OpenFile(logfile,
+		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write to log file %s: %s",
+			logfile, err)
+	}
+	return logwriter, nil
+}
+
+func openLog(logfile, loglevel,
+	logformat string) (*os.File, *prislog.PrisLog, error) {
+
+	logwriter, err := openLogFile(logfile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l, err := logging.NewLogger(logwriter, loglevel, logformat)
+
+	if err != nil {
+		if !isStdio(logwriter) {
+			logwriter.Close()
+		}
+		return nil, nil, fmt.Errorf("Error initializing logger: %s", err)
+	}
+
+	return logwriter, l, nil
+}
+
+func isStdio(f *os.File) bool {
+	return f == os.Stdout || f == os.Stderr
+}
+
+func (r *reloader) close() {
+	if r.logwriter != nil && !isStdio(r.logwriter) {
+		r.logwriter.Close()
+	}
+}
+
+// reload re-reads the config file and applies whatever can be changed on a
+// live connection. Changes that would need a reconnect are logged and
+// ignored, the running values stay in effect.
+func (r *reloader) reload() error {
+	if r.confFile == "" {
+		return fmt.Errorf("No config file to reload")
+	}
+
+	logger.Info.Println("Reloading config from", r.confFile)
+
+	settings, err := loadAdapterConfig(r.confFile, r.confName)
+
+	if errs, ok := err.(configErrors); ok {
+		for _, err := range errs {
+			logger.Error.Println("Config error:", r.confFile+":", err)
+		}
+		return fmt.Errorf("Invalid config, nothing reloaded")
+	} else if err != nil {
+		return err
+	}
+
+	params := mergeParams(r.base, settings.params)
+
+	for _, key := range restartParams {
+		if params[key] != r.params[key] {
+			logger.Warn.Printf("Change of %q requires a restart, ignored\n",
+				key)
+			params[key] = r.params[key]
+		}
+	}
+
+	if settings.port != r.port {
+		logger.Warn.Println("Change of \"port\" requires a restart, ignored")
+	}
+
+	if settings.secret != r.secret {
+		logger.Warn.Println("Change of \"secret\" requires a restart, ignored")
+	}
+
+	accounts := make(map[string]map[string]string, len(r.accounts))
+
+	for name, current := range r.accounts {
+		updated, ok := settings.accounts[name]
+		if !ok {
+			logger.Warn.Printf("Removing account %q requires a restart, "+
+				"ignored\n", name)
+			accounts[name] = current
+			continue
+		}
+
+		for _, key := range []string{"user", "pass", "nick"} {
+			if updated[key] != current[key] {
+				logger.Warn.Printf("Change of %q in account %q requires a "+
+					"restart, ignored\n", key, name)
+				updated[key] = current[key]
+			}
+		}
+		accounts[name] = updated
+	}
+
+	for name := range settings.accounts {
+		if _, ok := r.accounts[name]; !ok {
+			logger.Warn.Printf("Adding account %q requires a restart, "+
+				"ignored\n", name)
+		}
+	}
+
+	// reopen the log even if unchanged, so rotated files are let go. The
+	// logger is shared, by priscilla's client too, it's switched over in
+	// place.
+	logwriter, err := openLogFile(params["logfile"])
+	if err == nil {
+		err = logging.Reconfigure(logger, logwriter, params["loglevel"],
+			params["logformat"])
+		if err != nil && !isStdio(logwriter) {
+			logwriter.Close()
+		}
+	}
+
+	if err != nil {
+		logger.Error.Println(err)
+		params["logfile"] = r.params["logfile"]
+		params["loglevel"] = r.params["loglevel"]
+		params["logformat"] = r.params["logformat"]
+	} else {
+		// nothing writes to the old file anymore
+		oldwriter := r.logwriter
+		r.logwriter = logwriter
+		if oldwriter != nil && oldwriter != logwriter && !isStdio(oldwriter) {
+			oldwriter.Close()
+		}
+	}
+
+	for _, name := range r.live {
+		rooms, rateLimit, err := clientSettings(params, accounts[name])
+		if err == nil {
+			err = r.bridge.Configure(name, rooms, rateLimit)
+		}
+		if err != nil {
+			logger.Error.Println("Account", name+":", err)
+		}
+	}
+
+	r.params = params
+	r.accounts = accounts
+
+	logger.Info.Println("Config reloaded")
+
+	return nil
+}
+
+// clientSettings picks the live settings of an account, values set on the
+// account override the adapter wide ones
+func clientSettings(params,
+	account map[string]string) (map[string]bool, time.Duration, error) {
+
+	rooms := params["rooms"]
+	if value, ok := account["rooms"]; ok {
+		rooms = value
+	}
+
+	rate := params["ratelimit"]
+	if value, ok := account["ratelimit"]; ok {
+		rate = value
+	}
+
+	var rateLimit time.Duration
+	var err error
+
+	if rate != "" {
+		rateLimit, err = time.ParseDuration(rate)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid ratelimit %q: %s", rate, err)
+		}
+	}
+
+	return parseRooms(rooms), rateLimit, nil
+}
+
+// parseRooms turns a comma separated room list into a set, an empty list
+// means no restriction
+func parseRooms(rooms string) map[string]bool {
+	if strings.TrimSpace(rooms) == "" {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, room := range strings.Split(rooms, ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			set[room] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,94 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"runtime"
+	"sort"
+)
+
+const (
+	NsDiscoInfo = "http://jabber.org/protocol/disco#info"
+	NsVersion   = "jabber:iq:version"
+)
+
+type discoIdentity struct {
+	XMLName  xml.Name `xml:"identity"`
+	Category string   `xml:"category,attr"`
+	Type     string   `xml:"type,attr"`
+	Name     string   `xml:"name,attr"`
+}
+
+type discoFeature struct {
+	XMLName xml.Name `xml:"feature"`
+	Var     string   `xml:"var,attr"`
+}
+
+type discoInfo struct {
+	XMLName  xml.Name `xml:"query"`
+	Ns       string   `xml:"xmlns,attr"`
+	Identity discoIdentity
+	Features []discoFeature
+}
+
+type softwareVersion struct {
+	XMLName xml.Name `xml:"query"`
+	Ns      string   `xml:"xmlns,attr"`
+	Name    string   `xml:"name"`
+	Version string   `xml:"version"`
+	Os      string   `xml:"os"`
+}
+
+// HandleDisco answers disco#info queries. The features are the namespaces of
+// the iqs handled at the time of the query, plus extra for what's supported
+// outside of iqs.
+func (c *Conn) HandleDisco(name string, extra ...string) {
+	c.Handle(NsDiscoInfo, "query", func(iq *IncomingIq) (interface{}, error) {
+		info := &discoInfo{
+			Ns: NsDiscoInfo,
+			Identity: discoIdentity{
+				Category: "client",
+				Type:     "bot",
+				Name:     name,
+			},
+		}
+
+		for _, feature := range c.featureList(extra) {
+			info.Features = append(info.Features, discoFeature{Var: feature})
+		}
+
+		return info, nil
+	})
+}
+
+// HandleVersion answers software version queries, XEP-0092
+func (c *Conn) HandleVersion(name, version string) {
+	c.Handle(NsVersion, "query", func(iq *IncomingIq) (interface{}, error) {
+		return &softwareVersion{
+			Ns:      NsVersion,
+			Name:    name,
+			Version: version,
+			Os:      runtime.GOOS + "/" + runtime.GOARCH,
+		}, nil
+	})
+}
+
+func (c *Conn) featureList(extra []string) []string {
+	set := make(map[string]bool)
+	for _, feature := range extra {
+		set[feature] = true
+	}
+
+	c.handlersMu.Lock()
+	for name := range c.handlers {
+		set[name.Space] = true
+	}
+	c.handlersMu.Unlock()
+
+	features := make([]string, 0, len(set))
+	for feature := range set {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	return features
+}
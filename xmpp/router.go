@@ -0,0 +1,286 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IqTimeout is how long to wait for the reply to an iq request
+const IqTimeout = 30 * time.Second
+
+// ErrConnClosed is returned when the connection closed before a write or
+// reply
+var ErrConnClosed = errors.New("Connection closed")
+
+// IncomingIq is an iq as received, the payload is decoded by whoever is
+// interested in it
+type IncomingIq struct {
+	XMLName xml.Name `xml:"iq"`
+	Type    string   `xml:"type,attr"`
+	Id      string   `xml:"id,attr"`
+	From    string   `xml:"from,attr"`
+	To      string   `xml:"to,attr"`
+	Payload []byte   `xml:",innerxml"`
+	Query   struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// StanzaError is the error condition of an iq reply, see RFC 6120 8.3
+type StanzaError struct {
+	XMLName   xml.Name `xml:"error"`
+	Type      string   `xml:"type,attr"`
+	Condition emptyElement
+}
+
+// NewStanzaError returns an error of the given type and defined condition,
+// such as "cancel" and "service-unavailable"
+func NewStanzaError(errorType, condition string) *StanzaError {
+	return &StanzaError{
+		Type: errorType,
+		Condition: emptyElement{
+			XMLName: xml.Name{Local: condition, Space: NsStanzas},
+		},
+	}
+}
+
+func (e *StanzaError) Error() string {
+	return e.Type + " " + e.Condition.XMLName.Local
+}
+
+// Handler answers an incoming get or set. The payload it returns goes into
+// the result, an error that's not a *StanzaError is reported as
+// internal-server-error.
+type Handler func(iq *IncomingIq) (interface{}, error)
+
+type streamError struct {
+	XMLName   xml.Name `xml:"error"`
+	Condition struct {
+		XMLName xml.Name
+	} `xml:",any"`
+	Text string `xml:"text"`
+}
+
+type iqError struct {
+	id      string
+	payload string
+}
+
+func (e *iqError) Error() string {
+	return fmt.Sprintf("Error reply to iq %s: %s", e.id, e.payload)
+}
+
+// Event is a stanza the router passes on, or the error that ended the
+// stream. Exactly one field is set.
+type Event struct {
+	Message *Message
+	Iq      *IncomingIq
+	Err     error
+}
+
+// Pending is an iq request waiting for its reply
+type Pending struct {
+	conn  *Conn
+	id    string
+	reply chan *IncomingIq
+}
+
+// DecodePayload decodes the payload of the iq into v, an empty payload
+// leaves v alone
+func (iq *IncomingIq) DecodePayload(v interface{}) error {
+	if len(iq.Payload) == 0 {
+		return nil
+	}
+	return xml.Unmarshal(iq.Payload, v)
+}
+
+// Handle registers the handler for get and set iqs whose payload is the
+// element local in namespace space. Those without a handler are answered with
+// service-unavailable.
+func (c *Conn) Handle(space, local string, handler Handler) {
+	c.handlersMu.Lock()
+	c.handlers[xml.Name{Space: space, Local: local}] = handler
+	c.handlersMu.Unlock()
+}
+
+// answer replies to an incoming get or set
+func (c *Conn) answer(iq *IncomingIq) error {
+	c.handlersMu.Lock()
+	handler, ok := c.handlers[iq.Query.XMLName]
+	c.handlersMu.Unlock()
+
+	reply := &Iq{Type: "result", Id: iq.Id, From: iq.To, To: iq.From}
+
+	var err error
+	if ok {
+		reply.Query, err = handler(iq)
+	} else {
+		err = NewStanzaError("cancel", "service-unavailable")
+	}
+
+	if err != nil {
+		stanzaErr, ok := err.(*StanzaError)
+		if !ok {
+			logger.Error.Println("Failed to handle iq", iq.Id, "from",
+				iq.From+":", err)
+			stanzaErr = NewStanzaError("wait", "internal-server-error")
+		}
+		reply.Type = "error"
+		reply.Query = stanzaErr
+	}
+
+	return c.Encode(reply)
+}
+
+// Send sends an iq request, the reply is routed back to the returned
+// Pending by id
+func (c *Conn) Send(iq *Iq) (*Pending, error) {
+	p := &Pending{conn: c, id: iq.Id, reply: make(chan *IncomingIq, 1)}
+
+	c.pendingMu.Lock()
+	c.pending[iq.Id] = p.reply
+	c.pendingMu.Unlock()
+
+	if err := c.Encode(iq); err != nil {
+		p.forget()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Pending) forget() {
+	p.conn.pendingMu.Lock()
+	delete(p.conn.pending, p.id)
+	p.conn.pendingMu.Unlock()
+}
+
+// waiter returns where the reply with the given id goes
+func (c *Conn) waiter(id string) (chan *IncomingIq, bool) {
+	c.pendingMu.Lock()
+	reply, ok := c.pending[id]
+	c.pendingMu.Unlock()
+
+	return reply, ok
+}
+
+// Reply resolves with the reply, once it arrives
+func (p *Pending) Reply() <-chan *IncomingIq {
+	return p.reply
+}
+
+// Wait waits for the reply, until ctx is done, and decodes its payload into
+// result unless result is nil. An error reply is returned as *iqError.
+func (p *Pending) Wait(ctx context.Context, result interface{}) error {
+	defer p.forget()
+
+	select {
+	case reply := <-p.reply:
+		if reply.Type == "error" {
+			return &iqError{id: p.id, payload: string(reply.Payload)}
+		}
+		if result != nil {
+			return reply.DecodePayload(result)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("No reply to iq %s: %s", p.id, ctx.Err())
+	case <-p.conn.closed:
+		return ErrConnClosed
+	}
+}
+
+// Request sends an iq request and waits for the reply
+func (c *Conn) Request(ctx context.Context, iq *Iq,
+	result interface{}) error {
+
+	p, err := c.Send(iq)
+	if err != nil {
+		return err
+	}
+	return p.Wait(ctx, result)
+}
+
+// Route reads the stream until it fails, handing replies to the pending
+// requests and everything else to events. Whatever goes wrong ends up as an
+// error event, so the connection can be re-established.
+func (c *Conn) Route(events chan<- *Event) {
+	send := func(event *Event) bool {
+		select {
+		case events <- event:
+			return true
+		case <-c.closed:
+			return false
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			send(&Event{Err: fmt.Errorf("Failed to handle stanza: %v", r)})
+		}
+	}()
+
+	for {
+		element, err := c.RecvNext()
+
+		if err != nil {
+			send(&Event{Err: err})
+			return
+		}
+
+		switch element.Name.Local {
+		case "message":
+			message := new(Message)
+			if err := c.DecodeElement(message, &element); err != nil {
+				send(&Event{Err: err})
+				return
+			}
+			if !send(&Event{Message: message}) {
+				return
+			}
+		case "iq":
+			iq := new(IncomingIq)
+			if err := c.DecodeElement(iq, &element); err != nil {
+				send(&Event{Err: err})
+				return
+			}
+
+			if iq.Type == "get" || iq.Type == "set" {
+				if err := c.answer(iq); err != nil {
+					send(&Event{Err: err})
+					return
+				}
+				continue
+			}
+
+			if iq.Type == "result" || iq.Type == "error" {
+				if reply, ok := c.waiter(iq.Id); ok {
+					select {
+					case reply <- iq:
+					default:
+						// a duplicate reply, the first one counts
+					}
+					continue
+				}
+			}
+
+			if !send(&Event{Iq: iq}) {
+				return
+			}
+		case "error":
+			var streamErr streamError
+			c.DecodeElement(&streamErr, &element)
+			send(&Event{Err: fmt.Errorf("Stream error: %s %s",
+				streamErr.Condition.XMLName.Local, streamErr.Text)})
+			return
+		default:
+			if err := c.Skip(); err != nil {
+				send(&Event{Err: err})
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+)
+
+// StanzaTap receives every complete stanza going over a connection, stream
+// headers included, direction is "in" or "out"
+type StanzaTap func(direction, stanza string)
+
+// splitStanzas cuts the raw stream read from r into top level elements and
+// hands each to the taps. It always reads r to the end, the connection
+// blocks otherwise.
+func splitStanzas(r io.Reader, direction string, taps []StanzaTap) {
+	defer io.Copy(ioutil.Discard, r)
+
+	var buf bytes.Buffer
+	var base, start int64
+	depth := 0
+
+	decoder := xml.NewDecoder(io.TeeReader(r, &buf))
+
+	emit := func(end int64) {
+		stanza := string(buf.Bytes()[start-base : end-base])
+		for _, tap := range taps {
+			tap(direction, stanza)
+		}
+	}
+
+	// drop what's been dealt with, so buf only holds the current stanza
+	trim := func(end int64) {
+		buf.Next(int(end - base))
+		base = end
+	}
+
+	for {
+		offset := decoder.InputOffset()
+		t, err := decoder.RawToken()
+
+		if err != nil {
+			return
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth <= 1 {
+				start = offset
+			}
+			depth++
+			// the stream header is never closed, pass it on by itself
+			if depth == 1 && t.Name.Local == "stream" {
+				emit(decoder.InputOffset())
+				trim(decoder.InputOffset())
+			}
+		case xml.EndElement:
+			depth--
+			if depth <= 1 {
+				if depth == 0 {
+					start = offset
+				}
+				emit(decoder.InputOffset())
+				trim(decoder.InputOffset())
+			}
+		default:
+			if depth <= 1 {
+				trim(decoder.InputOffset())
+			}
+		}
+	}
+}
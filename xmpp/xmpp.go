@@ -0,0 +1,589 @@
+// Package xmpp is the XMPP client side of the adapter, as much of it as
+// HipChat needs: login, a stanza router matching iq replies to requests, and
+// a single writer goroutine owning the socket.
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/priscillachat/priscilla-hipchat/internal/logging"
+	"github.com/priscillachat/prisclient"
+	"github.com/priscillachat/prislog"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	NsStream     = "http://etherx.jabber.org/streams"
+	NsTLS        = "urn:ietf:params:xml:ns:xmpp-tls"
+	NsHipchat    = "http://hipchat.com"
+	NsDiscoItems = "http://jabber.org/protocol/disco#items"
+	NsMuc        = "http://jabber.org/protocol/muc"
+	NsAuth       = "http://hipchat.com/protocol/auth"
+	NsPing       = "urn:xmpp:ping"
+	NsVCard      = "vcard-temp"
+	NsStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+	LoginTimeout = 30 * time.Second
+
+	streamStart = `<stream:stream
+		xmlns='jabber:client'
+		xmlns:stream='http://etherx.jabber.org/streams'
+		from='%s'
+		to='%s'
+		version='1.0'>`
+	streamEnd = "</stream:stream>"
+)
+
+var logger, _ = prislog.NewLogger(os.Stderr, "warn")
+
+// SetLogger sets the logger of the package
+func SetLogger(l *prislog.PrisLog) {
+	logger = l
+}
+
+// ErrNotConnected is returned by writes before the login is done
+var ErrNotConnected = errors.New(
+	"Not connected, the connection is being (re-)established")
+
+// Conn is a connection to the server. The writer and encoder are only used
+// directly during login, after that the writer goroutine owns the socket and
+// everything is sent through write.
+type Conn struct {
+	raw     net.Conn
+	writer  io.Writer
+	decoder *xml.Decoder
+	encoder *xml.Encoder
+	writes  chan *xmppWrite
+	started chan struct{}
+	taps    []StanzaTap
+	tapIn   *io.PipeWriter
+	tapOut  *io.PipeWriter
+
+	// iq requests waiting for their reply, by id
+	pendingMu sync.Mutex
+	pending   map[string]chan *IncomingIq
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	handlersMu sync.Mutex
+	handlers   map[xml.Name]Handler
+}
+
+type xmppWrite struct {
+	data []byte
+	done chan error
+}
+
+type emptyElement struct {
+	XMLName xml.Name
+}
+
+type required struct{}
+
+// Features are the stream features the server offers
+type Features struct {
+	XMLName    xml.Name  `xml:"features"`
+	StartTLS   *required `xml:"starttls>required"`
+	Mechanisms []string  `xml:"mechanisms>mechanism"`
+}
+
+// AuthResponse is HipChat's reply to a successful login, with the hosts
+// and the OAuth token of the session
+type AuthResponse struct {
+	XMLName  xml.Name `xml:"success"`
+	Jid      string   `xml:"jid,attr"`
+	ApiHost  string   `xml:"api_host,attr"`
+	ChatHost string   `xml:"chat_host,attr"`
+	MucHost  string   `xml:"muc_host,attr"`
+	WebHost  string   `xml:"web_host,attr"`
+	Token    string   `xml:"oauth2_token,attr"`
+}
+
+// Iq is an outgoing iq, Query is marshalled as its payload
+type Iq struct {
+	XMLName xml.Name `xml:"iq"`
+	Type    string   `xml:"type,attr"`
+	Id      string   `xml:"id,attr"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Query   interface{}
+}
+
+type presence struct {
+	XMLName xml.Name `xml:"presence"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Id      string   `xml:"id,attr,omitempty"`
+	From    string   `xml:"from,attr"`
+	To      string   `xml:"to,attr,omitempty"`
+	Status  interface{}
+}
+
+type auth struct {
+	XMLName xml.Name `xml:"auth"`
+	Ns      string   `xml:"xmlns,attr"`
+	Value   string   `xml:",chardata"`
+	Oauth   string   `xml:"oauth2_token,attr,omitempty"`
+}
+
+type show struct {
+	XMLName xml.Name `xml:"show"`
+	Value   string   `xml:",chardata"`
+}
+
+// Message is a message stanza, with the room details of a HipChat invite and
+// the room extension of HipChat notifications
+type Message struct {
+	XMLName  xml.Name `xml:"message"`
+	Type     string   `xml:"type,attr"`
+	From     string   `xml:"from,attr"`
+	FromJid  string   `xml:"from_jid,attr"`
+	To       string   `xml:"to,attr"`
+	Id       string   `xml:"id,attr"`
+	Body     string   `xml:"body"`
+	RoomName string   `xml:"x>name,omitempty"`
+	RoomId   string   `xml:"x>id,omitempty"`
+	File     *File    `xml:"x>file,omitempty"`
+	// Format is "html" or "text" on notifications, Sender the integration
+	// that posted it
+	Format string `xml:"x>message_format,omitempty"`
+	Sender string `xml:"x>from,omitempty"`
+	Color  string `xml:"x>color,omitempty"`
+}
+
+// Notification tells whether the message was posted by an integration rather
+// than said by someone in the room
+func (m *Message) Notification() bool {
+	return m.Format != "" || m.Sender != ""
+}
+
+// File is what HipChat tells about a file shared in a room
+type File struct {
+	Name     string `xml:"name"`
+	Size     int64  `xml:"size"`
+	Url      string `xml:"url"`
+	ThumbUrl string `xml:"thumb_url,omitempty"`
+}
+
+// Room is a room as discovered, Id is its jid
+type Room struct {
+	XMLName xml.Name `xml:"item"`
+	Id      string   `xml:"jid,attr"`
+	Name    string   `xml:"name,attr"`
+}
+
+type discoItems struct {
+	XMLName xml.Name `xml:"query"`
+	Rooms   []Room   `xml:"item"`
+}
+
+type vCardRequest struct {
+	XMLName xml.Name `xml:"vCard"`
+	Ns      string   `xml:"xmlns,attr"`
+}
+
+// Card is the part of a vCard HipChat fills in
+type Card struct {
+	XMLName  xml.Name `xml:"vCard"`
+	Name     string   `xml:"FN"`
+	Nickname string   `xml:"NICKNAME"`
+	Email    string   `xml:"EMAIL>USERID"`
+}
+
+// User is what's known about a HipChat user, Mention is the @mention name
+// without the @
+type User struct {
+	Jid     string
+	Name    string
+	Mention string
+	Email   string
+}
+
+// NewConn starts an XMPP connection over raw
+func NewConn(raw net.Conn) *Conn {
+	c := &Conn{
+		raw:      raw,
+		writes:   make(chan *xmppWrite),
+		started:  make(chan struct{}),
+		pending:  make(map[string]chan *IncomingIq),
+		closed:   make(chan struct{}),
+		handlers: make(map[xml.Name]Handler),
+	}
+	if raw != nil {
+		c.resetStreams()
+	}
+	return c
+}
+
+// Dial connects to the XMPP server at host
+func Dial(host string) (*Conn, error) {
+	conn, err := net.Dial("tcp", host+":5222")
+
+	if err != nil {
+		return NewConn(nil), err
+	}
+
+	return NewConn(conn), nil
+}
+
+// Tap has every stanza sent or received from now on passed to tap
+func (c *Conn) Tap(tap StanzaTap) {
+	c.taps = append(c.taps, tap)
+	c.resetStreams()
+}
+
+// resetStreams sets up the decoder and encoder on the raw connection, either
+// at the start of a stream or once it switched to TLS. With taps, both
+// directions are teed into a stanza splitter.
+func (c *Conn) resetStreams() {
+	c.closeTaps()
+
+	var reader io.Reader = c.raw
+	c.writer = c.raw
+
+	if len(c.taps) > 0 {
+		var tapIn, tapOut *io.PipeReader
+		tapIn, c.tapIn = io.Pipe()
+		tapOut, c.tapOut = io.Pipe()
+
+		go splitStanzas(tapIn, "in", c.taps)
+		go splitStanzas(tapOut, "out", c.taps)
+
+		reader = io.TeeReader(c.raw, c.tapIn)
+		c.writer = io.MultiWriter(c.raw, c.tapOut)
+	}
+
+	c.decoder = xml.NewDecoder(reader)
+	c.encoder = xml.NewEncoder(c.writer)
+}
+
+func (c *Conn) closeTaps() {
+	if c.tapIn != nil {
+		c.tapIn.Close()
+		c.tapOut.Close()
+		c.tapIn, c.tapOut = nil, nil
+	}
+}
+
+// Disconnect closes the connection, pending requests fail with
+// ErrConnClosed
+func (c *Conn) Disconnect() {
+	c.closeOnce.Do(func() {
+		if c.raw != nil {
+			c.raw.Close()
+		}
+		c.closeTaps()
+		close(c.closed)
+	})
+}
+
+// StartWriter hands the socket over to the writer goroutine, once the login
+// is done
+func (c *Conn) StartWriter() {
+	close(c.started)
+	go c.writeLoop()
+}
+
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case w := <-c.writes:
+			_, err := c.writer.Write(w.data)
+			w.done <- err
+			if err != nil {
+				// the router notices and the connection is re-established
+				c.Disconnect()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// write sends data through the writer goroutine. It fails right away while
+// the connection is not (yet) established.
+func (c *Conn) write(data []byte) error {
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+
+	select {
+	case <-c.started:
+	default:
+		return ErrNotConnected
+	}
+
+	w := &xmppWrite{data: data, done: make(chan error, 1)}
+
+	select {
+	case c.writes <- w:
+	case <-c.closed:
+		return ErrConnClosed
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-c.closed:
+		return ErrConnClosed
+	}
+}
+
+// SetWriteDeadline bounds the writes still to come, so a peer that stopped
+// reading can't block them forever. A zero time clears it.
+func (c *Conn) SetWriteDeadline(t time.Time) {
+	if c.raw != nil {
+		c.raw.SetWriteDeadline(t)
+	}
+}
+
+// SetLoginDeadline bounds how long the login may take, a zero time clears it
+func (c *Conn) SetLoginDeadline(t time.Time) {
+	if c.raw != nil {
+		c.raw.SetReadDeadline(t)
+	}
+}
+
+// StreamStart opens the stream to host, during the login
+func (c *Conn) StreamStart(id, host string) {
+	fmt.Fprintf(c.writer, streamStart, id, host)
+}
+
+// RecvNext reads up to the next start element, during the login
+func (c *Conn) RecvNext() (element xml.StartElement, err error) {
+	for {
+		var t xml.Token
+		t, err = c.decoder.Token()
+		if err != nil {
+			return element, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			element = t
+			if element.Name.Local == "" {
+				err = errors.New("Bad XML response")
+				return
+			}
+
+			return
+		}
+	}
+}
+
+// StartTLS asks the server to start TLS
+func (c *Conn) StartTLS() {
+	starttls := emptyElement{
+		XMLName: xml.Name{Local: "starttls", Space: NsTLS},
+	}
+	c.encoder.Encode(starttls)
+}
+
+// UseTLS switches the connection to TLS once the server proceeded, the
+// stream has to be started again
+func (c *Conn) UseTLS(host string) {
+	c.raw = tls.Client(c.raw, &tls.Config{ServerName: host})
+	c.resetStreams()
+}
+
+// AuthRequest logs in with HipChat's auth mechanism, asking for an OAuth
+// token along
+func (c *Conn) AuthRequest(username, password, resource string) error {
+	token := []byte{'\x00'}
+	token = append(token, []byte(username)...)
+	token = append(token, '\x00')
+	token = append(token, []byte(password)...)
+	token = append(token, '\x00')
+	token = append(token, []byte(resource)...)
+
+	encodedToken := base64.StdEncoding.EncodeToString(token)
+
+	auth := auth{
+		Ns:    NsHipchat,
+		Value: encodedToken,
+		Oauth: "true",
+	}
+	// out, _ := xml.Marshal(auth)
+	// fmt.Println(string(out))
+	return c.encoder.Encode(auth)
+}
+
+// Available tells the server from is available to chat
+func (c *Conn) Available(from string) error {
+	available := presence{
+		Id:     prisclient.RandomId(),
+		From:   from,
+		Status: &show{Value: "chat"},
+	}
+
+	return c.Encode(available)
+}
+
+// Unavailable signs from off
+func (c *Conn) Unavailable(from string) error {
+	unavailable := presence{
+		Type: "unavailable",
+		Id:   prisclient.RandomId(),
+		From: from,
+	}
+
+	return c.Encode(unavailable)
+}
+
+// StreamEnd closes the stream
+func (c *Conn) StreamEnd() error {
+	return c.write([]byte(streamEnd))
+}
+
+// Discover lists the rooms of the conference server to
+func (c *Conn) Discover(ctx context.Context,
+	from, to string) ([]Room, error) {
+
+	discover := &Iq{
+		Type: "get",
+		Id:   prisclient.RandomId(),
+		From: from,
+		To:   to,
+		Query: &emptyElement{
+			XMLName: xml.Name{Local: "query", Space: NsDiscoItems},
+		},
+	}
+
+	var result discoItems
+	err := c.Request(ctx, discover, &result)
+
+	return result.Rooms, err
+}
+
+// KeepAlive sends whitespace to keep the connection open
+func (c *Conn) KeepAlive() error {
+	return c.write([]byte(" "))
+}
+
+// Ping sends an XMPP ping (XEP-0199) to to, the reply comes to the
+// returned Pending
+func (c *Conn) Ping(from, to string) (*Pending, error) {
+	ping := &Iq{
+		Type: "get",
+		Id:   prisclient.RandomId(),
+		From: from,
+		To:   to,
+		Query: &emptyElement{
+			XMLName: xml.Name{Local: "ping", Space: NsPing},
+		},
+	}
+
+	return c.Send(ping)
+}
+
+// Skip skips the element just read with RecvNext
+func (c *Conn) Skip() error {
+	return c.decoder.Skip()
+}
+
+// DecodeElement decodes the element started with start into v
+func (c *Conn) DecodeElement(v interface{}, start *xml.StartElement) error {
+	return c.decoder.DecodeElement(v, start)
+}
+
+// Join joins rooms as nick
+func (c *Conn) Join(from, nick string, rooms []string) error {
+	for _, room := range rooms {
+		join := presence{
+			Id:   prisclient.RandomId(),
+			From: from,
+			To:   room + "/" + nick,
+			Status: &emptyElement{
+				XMLName: xml.Name{Local: "x", Space: NsMuc},
+			},
+		}
+		out, _ := xml.Marshal(join)
+		logging.Event(logger.Debug, "Request to join room", logging.Fields{
+			"direction": "out",
+			"room":      room,
+			"id":        join.Id,
+			"stanza":    string(out),
+		})
+		if err := c.write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Leave leaves rooms
+func (c *Conn) Leave(from, nick string, rooms []string) error {
+	for _, room := range rooms {
+		leave := presence{
+			Type: "unavailable",
+			Id:   prisclient.RandomId(),
+			From: from,
+			To:   room + "/" + nick,
+		}
+		out, _ := xml.Marshal(leave)
+		logging.Event(logger.Debug, "Request to leave room", logging.Fields{
+			"direction": "out",
+			"room":      room,
+			"id":        leave.Id,
+			"stanza":    string(out),
+		})
+		if err := c.write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode sends v marshalled as XML
+func (c *Conn) Encode(v interface{}) error {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	logging.Event(logger.Debug, "Request encoded", logging.Fields{
+		"direction": "out",
+		"stanza":    string(out),
+	})
+	return c.write(out)
+}
+
+// VCard fetches the vCard of jid, or the own one when jid is empty
+func (c *Conn) VCard(ctx context.Context,
+	from, jid string) (*User, error) {
+
+	request := &Iq{
+		From: from,
+		To:   jid,
+		Id:   prisclient.RandomId(),
+		Type: "get",
+		Query: &vCardRequest{
+			Ns: NsVCard,
+		},
+	}
+
+	var card Card
+	if err := c.Request(ctx, request, &card); err != nil {
+		return nil, err
+	}
+
+	if jid == "" {
+		jid = from
+	}
+
+	return &User{
+		Jid:     jid,
+		Name:    card.Name,
+		Mention: card.Nickname,
+		Email:   card.Email,
+	}, nil
+}